@@ -1,32 +1,77 @@
 package asn
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 )
 
+// EnvDB is the environment variable consulted for the dataset path when none is given explicitly.
+const EnvDB = "TRACERT_ASN_DB"
+
+// DefaultPath is where the dataset is looked for when neither a path nor EnvDB is set.
+const DefaultPath = "./asn/ip2asn-v4.tsv"
+
+// DefaultSnapshotPath is where a compiled snapshot is looked for, before DefaultPath.
+const DefaultSnapshotPath = "./asn/ip2asn-v4.bin"
+
+// ErrNoDataset is returned by LoadLocal when no dataset could be located.
+var ErrNoDataset = errors.New("no ASN dataset available")
+
+// embeddedDB holds a gzip compressed ip2asn dataset or a compiled snapshot when built with the asnembed tag.
+var embeddedDB []byte
+
 type Query interface {
 	FindASN(ip string) (ASNData, error)
 }
 type ASNData struct {
-	IPStart, IPEnd net.IP
-	ASNNumber      string
-	CountryCode    string
-	ASName         string
+	IPStart     net.IP `json:"ip_start,omitempty"`
+	IPEnd       net.IP `json:"ip_end,omitempty"`
+	ASNNumber   string `json:"asn"`
+	CountryCode string `json:"country,omitempty"`
+	ASName      string `json:"name,omitempty"`
+	// Populated by backends that know them, e.g. CymruQuery
+	Prefix    string `json:"prefix,omitempty"`
+	Registry  string `json:"registry,omitempty"`
+	Allocated string `json:"allocated,omitempty"`
+	// Geolocation, populated by MMDBQuery from a City database. AccuracyRadius is in km, 0 when unknown
+	City           string  `json:"city,omitempty"`
+	Latitude       float64 `json:"latitude,omitempty"`
+	Longitude      float64 `json:"longitude,omitempty"`
+	AccuracyRadius uint16  `json:"accuracy_radius,omitempty"`
 }
 
 type Reader interface {
-	ReadAll(input *csv.Reader) Query
+	ReadAll(input *csv.Reader) (Query, error)
 }
 
 type RangeReader struct {
 	FromIPs []int
 	ToIPs   []int
 	ASNData []ASNData
+	// Lenient makes ReadAll skip malformed rows instead of failing, counting them in Skipped
+	Lenient bool
+	Skipped int
+}
+
+// ParseError reports a malformed row of the dataset along with its line number.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
 /*
@@ -34,35 +79,74 @@ type RangeReader struct {
 Expected format of the CSV file
 IPStart\tIPEnd\tASNNumber\tCountryCode\tASName
 */
-func (rangeReader *RangeReader) ReadAll(input *csv.Reader) {
+func (rangeReader *RangeReader) ReadAll(input *csv.Reader) (Query, error) {
+	read := false
 	for {
 		record, err := input.Read()
 		if err == io.EOF {
 			break
 		}
+		var csvErr *csv.ParseError
+		if err != nil && !errors.As(err, &csvErr) {
+			// an I/O error, e.g. a truncated gzip, doesn't go away by skipping a row
+			return nil, toParseError(input, read, err)
+		}
+		if err == nil {
+			read = true
+			err = rangeReader.handleRecord(record)
+		}
 		if err != nil {
-			log.Fatal("Error reading record: ", err)
+			perr := toParseError(input, read, err)
+			if !rangeReader.Lenient {
+				return nil, perr
+			}
+			rangeReader.Skipped++
 		}
-		rangeReader.handleRecord(record)
-
 	}
+	return rangeReader, nil
+}
 
+// toParseError adds the line number to err, read tells whether input has returned a record to take it from
+func toParseError(input *csv.Reader, read bool, err error) *ParseError {
+	var csvErr *csv.ParseError
+	if errors.As(err, &csvErr) {
+		return &ParseError{Line: csvErr.Line, Err: csvErr.Err}
+	}
+	line := 1
+	if read {
+		line, _ = input.FieldPos(0)
+	}
+	return &ParseError{Line: line, Err: err}
 }
+
 func NewRangeReader() *RangeReader {
 	return &RangeReader{FromIPs: make([]int, 0), ToIPs: make([]int, 0), ASNData: make([]ASNData, 0)}
 }
 
-func (rr *RangeReader) handleRecord(record []string) {
-	data := ASNData{IPStart: net.ParseIP(record[0]),
+func (rr *RangeReader) handleRecord(record []string) error {
+	if len(record) < 5 {
+		return fmt.Errorf("expected 5 fields, got %d", len(record))
+	}
+	data := ASNData{IPStart: net.ParseIP(record[0]).To4(),
 		IPEnd:       net.ParseIP(record[1]).To4(),
 		ASNNumber:   record[2],
 		CountryCode: record[3],
 		ASName:      record[4]}
+	if data.IPStart == nil {
+		return fmt.Errorf("invalid start IP %q", record[0])
+	}
+	if data.IPEnd == nil {
+		return fmt.Errorf("invalid end IP %q", record[1])
+	}
+	from, to := ToInt(data.IPStart), ToInt(data.IPEnd)
+	if from > to {
+		return fmt.Errorf("start IP %s is after end IP %s", data.IPStart, data.IPEnd)
+	}
 
-	rr.FromIPs = append(rr.FromIPs, ToInt(data.IPStart))
-	rr.ToIPs = append(rr.ToIPs, ToInt(data.IPEnd))
+	rr.FromIPs = append(rr.FromIPs, from)
+	rr.ToIPs = append(rr.ToIPs, to)
 	rr.ASNData = append(rr.ASNData, data)
-
+	return nil
 }
 
 func ToInt(ip net.IP) int {
@@ -92,17 +176,74 @@ func (rr *RangeReader) FindASN(ip string) (ASNData, error) {
 	return ASNData{}, fmt.Errorf("no ASN found: %s", ip)
 }
 
-func LoadLocal() Query {
-	file, err := os.Open("./asn/ip2asn-v4.tsv")
+/*
+LoadLocal loads the ip2asn dataset, trying in order:
+the given path, the file named by EnvDB, the embedded dataset (asnembed build tag), DefaultSnapshotPath and DefaultPath.
+Each may be plain TSV, gzip compressed or a compiled snapshot (see Snapshot). ErrNoDataset is returned if none of them is available.
+In lenient mode malformed rows are skipped and counted in RangeReader.Skipped, otherwise the first one
+is returned as a *ParseError.
+*/
+func LoadLocal(path string, lenient bool) (Query, error) {
+	if path == "" {
+		path = os.Getenv(EnvDB)
+	}
+	if path != "" {
+		return LoadFile(path, lenient)
+	}
+	if len(embeddedDB) > 0 {
+		if IsSnapshot(embeddedDB) {
+			return SnapshotFromBytes(embeddedDB)
+		}
+		return load(bytes.NewReader(embeddedDB), lenient)
+	}
+	for _, path := range []string{DefaultSnapshotPath, DefaultPath} {
+		if _, err := os.Stat(path); err == nil {
+			return LoadFile(path, lenient)
+		}
+	}
+	return nil, ErrNoDataset
+}
+
+// LoadFile loads the dataset from a plain or gzip compressed TSV file, or memory maps it if it is a compiled snapshot.
+func LoadFile(path string, lenient bool) (Query, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
-	reader := csv.NewReader(file)
+	magic := make([]byte, len(snapshotMagic))
+	if n, _ := io.ReadFull(file, magic); IsSnapshot(magic[:n]) {
+		return OpenSnapshot(path)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	query, err := load(file, lenient)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return query, nil
+}
+
+func load(r io.Reader, lenient bool) (Query, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress dataset: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	reader := csv.NewReader(r)
 	reader.Comma = '\t'
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
 	asnObj := NewRangeReader()
-	asnObj.ReadAll(reader)
-	return asnObj
+	asnObj.Lenient = lenient
+	return asnObj.ReadAll(reader)
 }
 
 ////////////// ----This reader implementation was experiment. RangeReader is the correct implementation//////////////
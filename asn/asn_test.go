@@ -1,10 +1,17 @@
 package asn
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/csv"
+	"errors"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewRangeReader(t *testing.T) {
@@ -166,3 +173,303 @@ func TestFindASN(t *testing.T) {
 	}*/
 
 }
+
+func TestLoadLocal(t *testing.T) {
+	sample := "testdata/ip2asn-sample.tsv"
+	raw, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatalf("failed to read sample: %v", err)
+	}
+	gzPath := filepath.Join(t.TempDir(), "ip2asn-v4.tsv.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(raw)
+	gz.Close()
+	if err := os.WriteFile(gzPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write gzip sample: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		env  string
+	}{
+		{name: "path", path: sample},
+		{name: "gzip", path: gzPath},
+		{name: "env", env: sample},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(EnvDB, test.env)
+			query, err := LoadLocal(test.path, false)
+			if err != nil {
+				t.Fatalf("failed to load dataset: %v", err)
+			}
+			got, err := query.FindASN("108.170.234.57")
+			if err != nil {
+				t.Fatalf("failed to find ASN: %v", err)
+			}
+			if got.ASNNumber != "15169" || got.ASName != "GOOGLE" {
+				t.Errorf("got: %v", got)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv(EnvDB, "")
+		if _, err := LoadLocal(filepath.Join(t.TempDir(), "missing.tsv"), false); err == nil {
+			t.Error("expected error for missing file")
+		}
+	})
+
+	t.Run("no dataset", func(t *testing.T) {
+		if embeddedDB != nil {
+			t.Skip("built with an embedded snapshot")
+		}
+		t.Setenv(EnvDB, "")
+		// DefaultPath is relative to the repo root, so it never resolves from the package directory
+		if _, err := LoadLocal("", false); err != ErrNoDataset {
+			t.Errorf("got: %v, want: %v", err, ErrNoDataset)
+		}
+	})
+
+	rr, err := LoadFile(sample, false)
+	if err != nil {
+		t.Fatalf("failed to load sample: %v", err)
+	}
+	var snapshot bytes.Buffer
+	if err := WriteSnapshot(&snapshot, rr.(*RangeReader)); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	t.Run("embedded snapshot", func(t *testing.T) {
+		defer func(db []byte) { embeddedDB = db }(embeddedDB)
+		embeddedDB = snapshot.Bytes()
+		t.Setenv(EnvDB, "")
+		query, err := LoadLocal("", false)
+		if _, ok := query.(*Snapshot); err != nil || !ok {
+			t.Fatalf("got: %T, %v, want: *Snapshot", query, err)
+		}
+		if got, err := query.FindASN("108.170.234.57"); err != nil || got.ASNNumber != "15169" {
+			t.Errorf("got: %v, %v", got, err)
+		}
+	})
+
+	t.Run("default snapshot", func(t *testing.T) {
+		if embeddedDB != nil {
+			t.Skip("built with an embedded snapshot")
+		}
+		t.Setenv(EnvDB, "")
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(DefaultSnapshotPath)), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, DefaultSnapshotPath), snapshot.Bytes(), 0644); err != nil {
+			t.Fatalf("failed to write snapshot: %v", err)
+		}
+		wd, _ := os.Getwd()
+		if err := os.Chdir(dir); err != nil {
+			t.Fatalf("failed to change directory: %v", err)
+		}
+		defer os.Chdir(wd)
+
+		query, err := LoadLocal("", false)
+		if _, ok := query.(*Snapshot); err != nil || !ok {
+			t.Fatalf("got: %T, %v, want: *Snapshot", query, err)
+		}
+		query.(*Snapshot).Close()
+	})
+}
+
+func TestReadAllMalformed(t *testing.T) {
+	input := "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"1.0.1.0\t1.0.3.255\t0\n" +
+		"1.0.4.0\tnot-an-ip\t38803\tAU\tGTELECOM\n" +
+		"1.0.9.0\t1.0.8.0\t4134\tCN\tCHINANET\n" +
+		"1.0.16.0\t1.0.16.255\t2519\tJP\tVECTANT\n"
+
+	newReader := func() *csv.Reader {
+		reader := csv.NewReader(strings.NewReader(input))
+		reader.Comma = '\t'
+		reader.FieldsPerRecord = -1
+		return reader
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := NewRangeReader().ReadAll(newReader())
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected ParseError, got: %v", err)
+		}
+		if perr.Line != 2 {
+			t.Errorf("got line: %d, want: 2", perr.Line)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		rr := NewRangeReader()
+		rr.Lenient = true
+		query, err := rr.ReadAll(newReader())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rr.Skipped != 3 {
+			t.Errorf("got skipped: %d, want: 3", rr.Skipped)
+		}
+		got, err := query.FindASN("1.0.16.7")
+		if err != nil || got.ASNNumber != "2519" {
+			t.Errorf("got: %v, %v", got, err)
+		}
+	})
+}
+
+// failingReader returns data, then err forever
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if n, err := r.data.Read(p); err != io.EOF {
+		return n, err
+	}
+	return 0, r.err
+}
+
+func TestReadAllReadError(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		lenient bool
+	}{
+		{"strict", "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n", false},
+		{"lenient", "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n", true},
+		{"before the first record", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := csv.NewReader(&failingReader{data: strings.NewReader(tt.data), err: io.ErrUnexpectedEOF})
+			reader.Comma = '\t'
+			reader.FieldsPerRecord = -1
+			rr := NewRangeReader()
+			rr.Lenient = tt.lenient
+			done := make(chan error, 1)
+			go func() {
+				_, err := rr.ReadAll(reader)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("got: %v, want: %v", err, io.ErrUnexpectedEOF)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("ReadAll didn't return on a read error")
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	query, err := LoadFile("testdata/ip2asn-sample.tsv", false)
+	if err != nil {
+		t.Fatalf("failed to load dataset: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ip2asn-v4.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	if err := WriteSnapshot(file, query.(*RangeReader)); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	file.Close()
+
+	loaded, err := LoadFile(path, false)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	snapshot, ok := loaded.(*Snapshot)
+	if !ok {
+		t.Fatalf("got %T, want *Snapshot", loaded)
+	}
+	defer snapshot.Close()
+	if snapshot.Len() != 6 {
+		t.Errorf("got %d ranges, want 6", snapshot.Len())
+	}
+
+	for _, ip := range []string{"1.5.140.0", "1.5.0.0", "1.5.255.255", "99.83.65.110", "108.170.234.57", "203.118.7.77", "207.45.219.137"} {
+		t.Run(ip, func(t *testing.T) {
+			want, err := query.FindASN(ip)
+			if err != nil {
+				t.Fatalf("failed to find ASN in dataset: %v", err)
+			}
+			got, err := snapshot.FindASN(ip)
+			if err != nil {
+				t.Fatalf("failed to find ASN in snapshot: %v", err)
+			}
+			if got.ASNNumber != want.ASNNumber || got.ASName != want.ASName || got.CountryCode != want.CountryCode ||
+				!got.IPStart.Equal(want.IPStart) || !got.IPEnd.Equal(want.IPEnd) {
+				t.Errorf("got: %v, want: %v", got, want)
+			}
+		})
+	}
+
+	for _, ip := range []string{"1.4.255.255", "1.6.0.0", "255.255.255.255", "0.0.0.0"} {
+		if _, err := snapshot.FindASN(ip); err == nil {
+			t.Errorf("expected no ASN for %s", ip)
+		}
+	}
+
+	if _, err := SnapshotFromBytes([]byte("ASNSNAP1\x00\x00\x00\x09\x00\x00\x00\x00")); err == nil {
+		t.Error("expected error for truncated snapshot")
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	query, err := LoadFile("testdata/ip2asn-sample.tsv", false)
+	if err != nil {
+		t.Fatalf("failed to load dataset: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, query.(*RangeReader)); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	valid := buf.Bytes()
+
+	for n := snapshotHeaderSize; n < len(valid); n++ {
+		if _, err := SnapshotFromBytes(valid[:n]); err == nil {
+			t.Errorf("expected error for snapshot truncated to %d bytes", n)
+		}
+	}
+
+	// whatever byte is damaged, the snapshot either fails to load or answers without panicking
+	for i := snapshotHeaderSize; i < len(valid); i++ {
+		for _, b := range []byte{0x00, 0x7f, 0xff} {
+			corrupt := append([]byte(nil), valid...)
+			corrupt[i] = b
+			s, err := SnapshotFromBytes(corrupt)
+			if err != nil {
+				continue
+			}
+			for _, ip := range []string{"0.0.0.0", "1.5.140.0", "99.83.65.110", "207.45.219.137", "255.255.255.255"} {
+				s.FindASN(ip)
+			}
+		}
+	}
+}
+
+func TestWriteSnapshotOverlap(t *testing.T) {
+	rr := NewRangeReader()
+	for _, record := range [][]string{
+		{"1.0.0.0", "1.0.255.255", "13335", "US", "CLOUDFLARENET"},
+		{"1.0.16.0", "1.0.16.255", "2519", "JP", "VECTANT"},
+	} {
+		if err := rr.handleRecord(record); err != nil {
+			t.Fatalf("failed to add record: %v", err)
+		}
+	}
+	if err := WriteSnapshot(io.Discard, rr); err == nil {
+		t.Error("expected error for overlapping ranges")
+	}
+}
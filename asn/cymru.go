@@ -0,0 +1,198 @@
+package asn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cymruOriginZone = "origin.asn.cymru.com"
+	cymruASZone     = "asn.cymru.com"
+)
+
+/*
+CymruQuery looks up ASN data with Team Cymru's IP to ASN mapping service over DNS.
+The origin record of an address is queried first
+
+	dig +short 4.108.90.216.origin.asn.cymru.com TXT
+	"23028 | 216.90.108.0/24 | US | arin | 1998-09-25"
+
+followed by the AS name record
+
+	dig +short AS23028.asn.cymru.com TXT
+	"23028 | US | arin | 2002-01-04 | TEAM-CYMRU - Team Cymru Inc., US"
+
+Answers are cached per BGP prefix and per AS, the most specific cached prefix holding an address wins. When
+the AS name can't be found the origin is still returned, with an empty name that is looked up again next time.
+Addresses without an origin, private and unannounced ones, are remembered for MissTTL so they aren't asked
+about on every hop, lookups that time out or fail otherwise are tried again. When a lookup fails and Fallback
+is set, it is consulted instead.
+*/
+type CymruQuery struct {
+	Resolver *net.Resolver
+	Fallback Query
+	Timeout  time.Duration
+	MissTTL  time.Duration
+
+	mu       sync.Mutex
+	prefixes []cymruPrefix
+	asNames  map[string]string
+	// misses holds when each address without an origin may be looked up again
+	misses map[string]time.Time
+}
+
+type cymruPrefix struct {
+	network *net.IPNet
+	data    ASNData
+}
+
+// NewCymruQuery creates a CymruQuery using resolver, or the default resolver when nil.
+func NewCymruQuery(resolver *net.Resolver, fallback Query) *CymruQuery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &CymruQuery{Resolver: resolver, Fallback: fallback, Timeout: 5 * time.Second, MissTTL: 5 * time.Minute,
+		asNames: make(map[string]string), misses: make(map[string]time.Time)}
+}
+
+func (c *CymruQuery) FindASN(ip string) (ASNData, error) {
+	data, err := c.lookup(ip)
+	if err != nil && c.Fallback != nil {
+		return c.Fallback.FindASN(ip)
+	}
+	return data, err
+}
+
+func (c *CymruQuery) lookup(ip string) (ASNData, error) {
+	ipAddr := net.ParseIP(ip).To4()
+	if ipAddr == nil {
+		return ASNData{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	if data, ok := c.cachedPrefix(ipAddr); ok {
+		if data.ASName == "" {
+			data.ASName, _ = c.asName(ctx, data.ASNNumber)
+		}
+		return data, nil
+	}
+	if c.missed(ipAddr.String()) {
+		return ASNData{}, fmt.Errorf("no ASN found: %s", ip)
+	}
+
+	name := fmt.Sprintf("%d.%d.%d.%d.%s", ipAddr[3], ipAddr[2], ipAddr[1], ipAddr[0], cymruOriginZone)
+	fields, err := c.lookupTXT(ctx, name, 5)
+	if err != nil {
+		// only an address without an origin is remembered, timeouts and server failures are tried again
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			c.mu.Lock()
+			c.misses[ipAddr.String()] = time.Now().Add(c.MissTTL)
+			c.mu.Unlock()
+		}
+		return ASNData{}, fmt.Errorf("no ASN found: %s: %v", ip, err)
+	}
+	// Multiple origin ASes are space separated, use the first one
+	asn := strings.Fields(fields[0])
+	if len(asn) == 0 {
+		return ASNData{}, fmt.Errorf("no ASN found: %s: empty origin", ip)
+	}
+	_, network, err := net.ParseCIDR(fields[1])
+	if err != nil {
+		return ASNData{}, fmt.Errorf("invalid BGP prefix for %s: %v", ip, err)
+	}
+	data := ASNData{
+		IPStart:     network.IP,
+		IPEnd:       lastIP(network),
+		ASNNumber:   asn[0],
+		CountryCode: fields[2],
+		Registry:    fields[3],
+		Allocated:   fields[4],
+		Prefix:      network.String(),
+	}
+	// the origin is worth having without the name, it is looked up again on the next hit of the prefix
+	data.ASName, _ = c.asName(ctx, data.ASNNumber)
+
+	c.mu.Lock()
+	c.prefixes = append(c.prefixes, cymruPrefix{network: network, data: data})
+	c.mu.Unlock()
+	return data, nil
+}
+
+// cachedPrefix returns the data of the most specific cached prefix holding ip, more specific announcements can have another origin
+func (c *CymruQuery) cachedPrefix(ip net.IP) (ASNData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	best, bestLen := -1, -1
+	for i, p := range c.prefixes {
+		if ones, _ := p.network.Mask.Size(); ones > bestLen && p.network.Contains(ip) {
+			best, bestLen = i, ones
+		}
+	}
+	if best < 0 {
+		return ASNData{}, false
+	}
+	return c.prefixes[best].data, true
+}
+
+// missed reports whether ip was found to have no origin less than MissTTL ago
+func (c *CymruQuery) missed(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.misses[ip]
+	if ok && time.Now().After(until) {
+		delete(c.misses, ip)
+		return false
+	}
+	return ok
+}
+
+func (c *CymruQuery) asName(ctx context.Context, asn string) (string, error) {
+	c.mu.Lock()
+	name, ok := c.asNames[asn]
+	c.mu.Unlock()
+	if ok {
+		return name, nil
+	}
+	fields, err := c.lookupTXT(ctx, "AS"+asn+"."+cymruASZone, 5)
+	if err != nil {
+		return "", fmt.Errorf("failed to find AS name for %s: %v", asn, err)
+	}
+	name = fields[4]
+	c.mu.Lock()
+	c.asNames[asn] = name
+	c.mu.Unlock()
+	return name, nil
+}
+
+// lookupTXT resolves name and splits the first TXT record on '|', expecting at least n fields.
+func (c *CymruQuery) lookupTXT(ctx context.Context, name string, n int) ([]string, error) {
+	records, err := c.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no TXT record for %s", name)
+	}
+	fields := strings.Split(records[0], "|")
+	if len(fields) < n {
+		return nil, fmt.Errorf("malformed TXT record for %s: %q", name, records[0])
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, nil
+}
+
+func lastIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
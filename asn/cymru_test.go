@@ -0,0 +1,266 @@
+package asn
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeCymru is a stand-in DNS server answering TXT queries from a fixed table.
+type fakeCymru struct {
+	conn    net.PacketConn
+	records map[string]string
+	mu      sync.Mutex
+	queries map[string]int
+	// failing makes every query fail with SERVFAIL
+	failing bool
+}
+
+func startFakeCymru(t *testing.T, records map[string]string) *fakeCymru {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &fakeCymru{conn: conn, records: records, queries: make(map[string]int)}
+	go srv.serve()
+	t.Cleanup(func() { conn.Close() })
+	return srv
+}
+
+func (f *fakeCymru) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, peer, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		question, err := p.Question()
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+		f.mu.Lock()
+		f.queries[name]++
+		txt, ok := f.records[name]
+		failing := f.failing
+		f.mu.Unlock()
+
+		header.Response = true
+		header.Authoritative = true
+		if !ok || question.Type != dnsmessage.TypeTXT {
+			header.RCode = dnsmessage.RCodeNameError
+		}
+		if failing {
+			ok, header.RCode = false, dnsmessage.RCodeServerFailure
+		}
+		b := dnsmessage.NewBuilder(nil, header)
+		b.StartQuestions()
+		b.Question(question)
+		b.StartAnswers()
+		if ok && question.Type == dnsmessage.TypeTXT {
+			b.TXTResource(dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.TXTResource{TXT: []string{txt}})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			continue
+		}
+		f.conn.WriteTo(msg, peer)
+	}
+}
+
+func (f *fakeCymru) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", f.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (f *fakeCymru) count(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[name]
+}
+
+type staticQuery ASNData
+
+func (s staticQuery) FindASN(ip string) (ASNData, error) {
+	return ASNData(s), nil
+}
+
+func TestCymruQuery(t *testing.T) {
+	srv := startFakeCymru(t, map[string]string{
+		"4.108.90.216.origin.asn.cymru.com":   "23028 | 216.90.108.0/24 | US | arin | 1998-09-25",
+		"as23028.asn.cymru.com":               "23028 | US | arin | 2002-01-04 | TEAM-CYMRU - Team Cymru Inc., US",
+		"57.234.170.108.origin.asn.cymru.com": "15169 396982 | 108.170.224.0/19 | US | arin | 2012-01-19",
+		"as15169.asn.cymru.com":               "15169 | US | arin | 2000-03-30 | GOOGLE - Google LLC, US",
+	})
+	query := NewCymruQuery(srv.resolver(), nil)
+
+	tests := []struct {
+		ip   string
+		want ASNData
+	}{
+		{
+			ip: "216.90.108.4",
+			want: ASNData{
+				ASNNumber:   "23028",
+				CountryCode: "US",
+				ASName:      "TEAM-CYMRU - Team Cymru Inc., US",
+				Prefix:      "216.90.108.0/24",
+				Registry:    "arin",
+				Allocated:   "1998-09-25",
+			},
+		},
+		{
+			ip: "108.170.234.57",
+			want: ASNData{
+				ASNNumber:   "15169",
+				CountryCode: "US",
+				ASName:      "GOOGLE - Google LLC, US",
+				Prefix:      "108.170.224.0/19",
+				Registry:    "arin",
+				Allocated:   "2012-01-19",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			got, err := query.FindASN(test.ip)
+			if err != nil {
+				t.Fatalf("failed to find ASN: %v", err)
+			}
+			if got.ASNNumber != test.want.ASNNumber || got.CountryCode != test.want.CountryCode || got.ASName != test.want.ASName ||
+				got.Prefix != test.want.Prefix || got.Registry != test.want.Registry || got.Allocated != test.want.Allocated {
+				t.Errorf("got: %v, want: %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("cached prefix", func(t *testing.T) {
+		got, err := query.FindASN("108.170.230.1")
+		if err != nil || got.ASNNumber != "15169" {
+			t.Fatalf("got: %v, %v", got, err)
+		}
+		if n := srv.count("1.230.170.108.origin.asn.cymru.com"); n != 0 {
+			t.Errorf("expected cached answer, server saw %d queries", n)
+		}
+		if got.IPEnd.String() != "108.170.255.255" {
+			t.Errorf("got IPEnd: %v", got.IPEnd)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := query.FindASN("10.1.2.3"); err == nil {
+			t.Error("expected error for unknown address")
+		}
+	})
+
+	t.Run("miss cached", func(t *testing.T) {
+		query.FindASN("10.1.2.3")
+		if n := srv.count("3.2.1.10.origin.asn.cymru.com"); n != 1 {
+			t.Errorf("got %d queries for an address without origin, want 1", n)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		query.Fallback = staticQuery{ASNNumber: "64512", ASName: "PRIVATE"}
+		got, err := query.FindASN("10.1.2.3")
+		if err != nil || got.ASNNumber != "64512" {
+			t.Errorf("got: %v, %v", got, err)
+		}
+	})
+}
+
+func TestCymruQueryNoASName(t *testing.T) {
+	srv := startFakeCymru(t, map[string]string{
+		"4.108.90.216.origin.asn.cymru.com": "23028 | 216.90.108.0/24 | US | arin | 1998-09-25",
+	})
+	query := NewCymruQuery(srv.resolver(), staticQuery{ASNNumber: "64512"})
+
+	got, err := query.FindASN("216.90.108.4")
+	if err != nil || got.ASNNumber != "23028" || got.ASName != "" || got.Prefix != "216.90.108.0/24" {
+		t.Fatalf("got: %v, %v, want the origin without a name", got, err)
+	}
+	// the name shows up later, the prefix is cached without it
+	srv.mu.Lock()
+	srv.records["as23028.asn.cymru.com"] = "23028 | US | arin | 2002-01-04 | TEAM-CYMRU - Team Cymru Inc., US"
+	srv.mu.Unlock()
+	got, err = query.FindASN("216.90.108.4")
+	if err != nil || got.ASName != "TEAM-CYMRU - Team Cymru Inc., US" {
+		t.Errorf("got: %v, %v", got, err)
+	}
+	if n := srv.count("4.108.90.216.origin.asn.cymru.com"); n != 1 {
+		t.Errorf("got %d origin queries, want 1", n)
+	}
+}
+
+func TestCymruQueryMissExpires(t *testing.T) {
+	srv := startFakeCymru(t, map[string]string{})
+	query := NewCymruQuery(srv.resolver(), nil)
+	query.MissTTL = 10 * time.Millisecond
+
+	query.FindASN("10.1.2.3")
+	time.Sleep(20 * time.Millisecond)
+	query.FindASN("10.1.2.3")
+	if n := srv.count("3.2.1.10.origin.asn.cymru.com"); n != 2 {
+		t.Errorf("got %d queries, want 2 once the miss expired", n)
+	}
+}
+
+func TestCymruQueryFailureNotCached(t *testing.T) {
+	srv := startFakeCymru(t, map[string]string{
+		"4.108.90.216.origin.asn.cymru.com": "23028 | 216.90.108.0/24 | US | arin | 1998-09-25",
+		"as23028.asn.cymru.com":             "23028 | US | arin | 2002-01-04 | TEAM-CYMRU - Team Cymru Inc., US",
+	})
+	query := NewCymruQuery(srv.resolver(), nil)
+
+	srv.mu.Lock()
+	srv.failing = true
+	srv.mu.Unlock()
+	if _, err := query.FindASN("216.90.108.4"); err == nil {
+		t.Fatal("got no error from a failing server")
+	}
+	srv.mu.Lock()
+	srv.failing = false
+	srv.mu.Unlock()
+	got, err := query.FindASN("216.90.108.4")
+	if err != nil || got.ASNNumber != "23028" {
+		t.Errorf("got: %v, %v, want: 23028 once the server recovered", got, err)
+	}
+}
+
+func TestCymruQueryMostSpecificPrefix(t *testing.T) {
+	query := NewCymruQuery(nil, nil)
+	for _, p := range []struct{ prefix, asn string }{{"10.1.0.0/16", "64500"}, {"10.1.5.0/24", "64501"}, {"10.0.0.0/8", "64502"}} {
+		_, network, _ := net.ParseCIDR(p.prefix)
+		query.prefixes = append(query.prefixes, cymruPrefix{network: network, data: ASNData{ASNNumber: p.asn}})
+	}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.5.6", "64501"},
+		{"10.1.2.3", "64500"},
+		{"10.2.0.1", "64502"},
+	}
+	for _, tt := range tests {
+		got, ok := query.cachedPrefix(net.ParseIP(tt.ip).To4())
+		if !ok || got.ASNNumber != tt.want {
+			t.Errorf("%s: got: %v %v, want: %s", tt.ip, got.ASNNumber, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build asnembed
+
+package asn
+
+import _ "embed"
+
+/*
+Building with -tags asnembed compiles a compressed dataset into the binary.
+Generate it before building with: gzip -9 -k asn/ip2asn-v4.tsv
+A compiled snapshot written to the same file is embedded as is and isn't parsed at startup:
+go run . asn compile asn/ip2asn-v4.tsv asn/ip2asn-v4.tsv.gz
+*/
+//go:embed ip2asn-v4.tsv.gz
+var embedded []byte
+
+func init() {
+	embeddedDB = embedded
+}
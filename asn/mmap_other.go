@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package asn
+
+import "os"
+
+// mapFile reads path into memory on platforms without mmap support.
+func mapFile(path string) ([]byte, func() error, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, func() error { return nil }, nil
+}
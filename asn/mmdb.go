@@ -0,0 +1,99 @@
+package asn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/monmohan/traceroute/mmdb"
+)
+
+/*
+MMDBQuery looks up addresses in MaxMind GeoLite2/GeoIP2 databases.
+ASN comes from an ASN database (GeoLite2-ASN), location from a City database (GeoLite2-City or GeoIP2-City).
+Either of them may be nil, an address is found if at least one database knows it.
+*/
+type MMDBQuery struct {
+	ASN      *mmdb.Reader
+	City     *mmdb.Reader
+	Language string
+}
+
+// OpenMMDB opens the ASN and City databases at the given paths, an empty path skips that database.
+func OpenMMDB(asnPath, cityPath string) (*MMDBQuery, error) {
+	q := &MMDBQuery{Language: "en"}
+	var err error
+	if asnPath != "" {
+		if q.ASN, err = mmdb.Open(asnPath); err != nil {
+			return nil, fmt.Errorf("%s: %v", asnPath, err)
+		}
+	}
+	if cityPath != "" {
+		if q.City, err = mmdb.Open(cityPath); err != nil {
+			return nil, fmt.Errorf("%s: %v", cityPath, err)
+		}
+	}
+	if q.ASN == nil && q.City == nil {
+		return nil, ErrNoDataset
+	}
+	return q, nil
+}
+
+func (q *MMDBQuery) FindASN(ip string) (ASNData, error) {
+	ipAddr := net.ParseIP(ip)
+	if ipAddr == nil {
+		return ASNData{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	var data ASNData
+	found := false
+
+	if q.ASN != nil {
+		record, network, err := q.ASN.Lookup(ipAddr)
+		if err == nil {
+			found = true
+			m, _ := record.(map[string]interface{})
+			if n, ok := m["autonomous_system_number"].(uint64); ok {
+				data.ASNNumber = fmt.Sprint(n)
+			}
+			data.ASName, _ = m["autonomous_system_organization"].(string)
+			data.IPStart, data.IPEnd, data.Prefix = network.IP, lastIP(network), network.String()
+		}
+	}
+
+	if q.City != nil {
+		record, network, err := q.City.Lookup(ipAddr)
+		if err == nil {
+			found = true
+			m, _ := record.(map[string]interface{})
+			data.City = q.name(m["city"])
+			if country, ok := m["country"].(map[string]interface{}); ok {
+				data.CountryCode, _ = country["iso_code"].(string)
+			}
+			if location, ok := m["location"].(map[string]interface{}); ok {
+				data.Latitude, _ = location["latitude"].(float64)
+				data.Longitude, _ = location["longitude"].(float64)
+				if r, ok := location["accuracy_radius"].(uint64); ok {
+					data.AccuracyRadius = uint16(r)
+				}
+			}
+			if data.IPStart == nil {
+				data.IPStart, data.IPEnd, data.Prefix = network.IP, lastIP(network), network.String()
+			}
+		}
+	}
+
+	if !found {
+		return ASNData{}, fmt.Errorf("no ASN found: %s", ip)
+	}
+	return data, nil
+}
+
+// name picks the localized name of a city or country record, falling back to English.
+func (q *MMDBQuery) name(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	names, _ := m["names"].(map[string]interface{})
+	if name, ok := names[q.Language].(string); ok {
+		return name
+	}
+	name, _ := names["en"].(string)
+	return name
+}
@@ -0,0 +1,102 @@
+package asn
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/monmohan/traceroute/mmdb"
+)
+
+func writeMMDB(t *testing.T, dbType string, records map[string]map[string]interface{}) string {
+	w := mmdb.NewWriter(dbType, 6)
+	for cidr, record := range records {
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := w.Insert(network, record); err != nil {
+			t.Fatalf("failed to insert %s: %v", cidr, err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), dbType+".mmdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer file.Close()
+	if _, err := w.WriteTo(file); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func TestMMDBQuery(t *testing.T) {
+	asnPath := writeMMDB(t, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"203.117.0.0/16":   {"autonomous_system_number": uint32(4657), "autonomous_system_organization": "StarHub Ltd"},
+		"108.170.224.0/19": {"autonomous_system_number": uint32(15169), "autonomous_system_organization": "GOOGLE"},
+	})
+	cityPath := writeMMDB(t, "GeoLite2-City", map[string]map[string]interface{}{
+		"203.117.0.0/16": {
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": "Singapore", "de": "Singapur"}},
+			"country":  map[string]interface{}{"iso_code": "SG"},
+			"location": map[string]interface{}{"latitude": 1.2897, "longitude": 103.8501, "accuracy_radius": uint16(20)},
+		},
+		"10.0.0.0/8": {"country": map[string]interface{}{"iso_code": "ZZ"}},
+	})
+
+	query, err := OpenMMDB(asnPath, cityPath)
+	if err != nil {
+		t.Fatalf("failed to open databases: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want ASNData
+	}{
+		{
+			ip: "203.117.8.1",
+			want: ASNData{ASNNumber: "4657", ASName: "StarHub Ltd", CountryCode: "SG", City: "Singapore",
+				Latitude: 1.2897, Longitude: 103.8501, AccuracyRadius: 20, Prefix: "203.117.0.0/16"},
+		},
+		{
+			ip:   "108.170.234.57",
+			want: ASNData{ASNNumber: "15169", ASName: "GOOGLE", Prefix: "108.170.224.0/19"},
+		},
+		{
+			ip:   "10.1.2.3",
+			want: ASNData{CountryCode: "ZZ", Prefix: "10.0.0.0/8"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			got, err := query.FindASN(test.ip)
+			if err != nil {
+				t.Fatalf("failed to find ASN: %v", err)
+			}
+			if got.ASNNumber != test.want.ASNNumber || got.ASName != test.want.ASName || got.CountryCode != test.want.CountryCode ||
+				got.City != test.want.City || got.Latitude != test.want.Latitude || got.Longitude != test.want.Longitude ||
+				got.AccuracyRadius != test.want.AccuracyRadius || got.Prefix != test.want.Prefix {
+				t.Errorf("got: %+v, want: %+v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("language", func(t *testing.T) {
+		query.Language = "de"
+		defer func() { query.Language = "en" }()
+		if got, _ := query.FindASN("203.117.8.1"); got.City != "Singapur" {
+			t.Errorf("got city: %s, want: Singapur", got.City)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := query.FindASN("8.8.8.8"); err == nil {
+			t.Error("expected error for unknown address")
+		}
+	})
+
+	t.Run("no databases", func(t *testing.T) {
+		if _, err := OpenMMDB("", ""); err != ErrNoDataset {
+			t.Errorf("got: %v, want: %v", err, ErrNoDataset)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package asn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+)
+
+/*
+A snapshot is a compact binary form of the ip2asn dataset, produced by `tracert asn compile`.
+It is memory mapped at runtime so loading is near instant and the pages are shared between processes.
+
+All integers are big endian.
+
+	+----------------------+---------------------+-------------------+
+	| magic "ASNSNAP1" (8) | range count (4)     | string count (4)  |
+	+----------------------+---------------------+-------------------+
+	| ranges, sorted by start IP, 20 bytes each:                     |
+	|   start IP (4) | end IP (4) | ASN (4) | country (4) | name (4) |
+	+----------------------------------------------------------------+
+	| string offsets, string count + 1 entries of 4 bytes            |
+	+----------------------------------------------------------------+
+	| string bytes, country codes and AS names interned once each    |
+	+----------------------------------------------------------------+
+*/
+var snapshotMagic = []byte("ASNSNAP1")
+
+const (
+	snapshotHeaderSize = 16
+	snapshotRangeSize  = 20
+)
+
+// Snapshot answers queries directly from the snapshot bytes, usually a memory mapped file.
+type Snapshot struct {
+	buf     []byte
+	ranges  []byte
+	offsets []byte
+	strings []byte
+	count   int
+	unmap   func() error
+}
+
+// IsSnapshot reports whether b starts with the snapshot magic.
+func IsSnapshot(b []byte) bool {
+	return bytes.HasPrefix(b, snapshotMagic)
+}
+
+// OpenSnapshot memory maps the snapshot at path. Close releases the mapping.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	buf, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := SnapshotFromBytes(buf)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s.unmap = unmap
+	return s, nil
+}
+
+/*
+SnapshotFromBytes validates and wraps a snapshot held in buf. Everything FindASN relies on is checked here,
+the ranges sorted and disjoint and the string table within bounds, so a corrupt file fails to load instead of
+failing a lookup later.
+*/
+func SnapshotFromBytes(buf []byte) (*Snapshot, error) {
+	if len(buf) < snapshotHeaderSize || !IsSnapshot(buf) {
+		return nil, errors.New("not an ASN snapshot")
+	}
+	count := uint64(binary.BigEndian.Uint32(buf[8:12]))
+	nstrings := uint64(binary.BigEndian.Uint32(buf[12:16]))
+	rangesEnd := snapshotHeaderSize + count*snapshotRangeSize
+	offsetsEnd := rangesEnd + (nstrings+1)*4
+	if offsetsEnd > uint64(len(buf)) {
+		return nil, errors.New("truncated ASN snapshot")
+	}
+	s := &Snapshot{
+		buf:     buf,
+		ranges:  buf[snapshotHeaderSize:rangesEnd],
+		offsets: buf[rangesEnd:offsetsEnd],
+		strings: buf[offsetsEnd:],
+		count:   int(count),
+	}
+
+	prev := uint32(0)
+	for i := uint64(0); i <= nstrings; i++ {
+		off := binary.BigEndian.Uint32(s.offsets[i*4:])
+		if off < prev || int(off) > len(s.strings) {
+			return nil, fmt.Errorf("invalid ASN snapshot string offset %d", i)
+		}
+		prev = off
+	}
+	for i := 0; i < s.count; i++ {
+		start, end := s.field(i, 0), s.field(i, 1)
+		if start > end || (i > 0 && start <= s.field(i-1, 1)) {
+			return nil, fmt.Errorf("invalid ASN snapshot range %d: not sorted or overlapping", i)
+		}
+		if uint64(s.field(i, 3)) >= nstrings || uint64(s.field(i, 4)) >= nstrings {
+			return nil, fmt.Errorf("invalid ASN snapshot range %d: string index out of range", i)
+		}
+	}
+	return s, nil
+}
+
+// Len returns the number of ranges in the snapshot.
+func (s *Snapshot) Len() int {
+	return s.count
+}
+
+// Close releases the memory mapping, the Snapshot must not be used afterwards.
+func (s *Snapshot) Close() error {
+	if s.unmap == nil {
+		return nil
+	}
+	err := s.unmap()
+	s.unmap, s.buf, s.ranges, s.offsets, s.strings = nil, nil, nil, nil, nil
+	return err
+}
+
+func (s *Snapshot) FindASN(ip string) (ASNData, error) {
+	ipAddr := net.ParseIP(ip).To4()
+	if ipAddr == nil {
+		return ASNData{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	in := binary.BigEndian.Uint32(ipAddr)
+	// Find the last range starting at or before the address
+	i := sort.Search(s.count, func(i int) bool {
+		return s.field(i, 0) > in
+	}) - 1
+	if i < 0 || s.field(i, 1) < in {
+		return ASNData{}, fmt.Errorf("no ASN found: %s", ip)
+	}
+	return ASNData{
+		IPStart:     uint32ToIP(s.field(i, 0)),
+		IPEnd:       uint32ToIP(s.field(i, 1)),
+		ASNNumber:   strconv.FormatUint(uint64(s.field(i, 2)), 10),
+		CountryCode: s.str(s.field(i, 3)),
+		ASName:      s.str(s.field(i, 4)),
+	}, nil
+}
+
+// field returns the n-th 4 byte field of range i.
+func (s *Snapshot) field(i int, n int) uint32 {
+	off := i*snapshotRangeSize + n*4
+	return binary.BigEndian.Uint32(s.ranges[off : off+4])
+}
+
+func (s *Snapshot) str(i uint32) string {
+	start := binary.BigEndian.Uint32(s.offsets[i*4:])
+	end := binary.BigEndian.Uint32(s.offsets[i*4+4:])
+	return string(s.strings[start:end])
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+/*
+WriteSnapshot writes the ranges loaded by rr as a snapshot. Ranges are sorted, overlapping ones are refused:
+the snapshot is searched for the range an address falls in, the dataset for the first one listed that has it,
+and with overlaps the two wouldn't agree.
+*/
+func WriteSnapshot(w io.Writer, rr *RangeReader) error {
+	order := make([]int, len(rr.ASNData))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return rr.FromIPs[order[a]] < rr.FromIPs[order[b]]
+	})
+	for k := 1; k < len(order); k++ {
+		prev, cur := rr.ASNData[order[k-1]], rr.ASNData[order[k]]
+		if rr.FromIPs[order[k]] <= rr.ToIPs[order[k-1]] {
+			return fmt.Errorf("range %s-%s overlaps %s-%s", cur.IPStart, cur.IPEnd, prev.IPStart, prev.IPEnd)
+		}
+	}
+
+	index := make(map[string]uint32)
+	var table []string
+	intern := func(s string) uint32 {
+		if i, ok := index[s]; ok {
+			return i
+		}
+		i := uint32(len(table))
+		index[s] = i
+		table = append(table, s)
+		return i
+	}
+
+	ranges := make([]byte, 0, len(order)*snapshotRangeSize)
+	for _, i := range order {
+		data := rr.ASNData[i]
+		asn, err := strconv.ParseUint(data.ASNNumber, 10, 32)
+		if err != nil {
+			return fmt.Errorf("range %s-%s: invalid ASN %q", data.IPStart, data.IPEnd, data.ASNNumber)
+		}
+		ranges = binary.BigEndian.AppendUint32(ranges, uint32(rr.FromIPs[i]))
+		ranges = binary.BigEndian.AppendUint32(ranges, uint32(rr.ToIPs[i]))
+		ranges = binary.BigEndian.AppendUint32(ranges, uint32(asn))
+		ranges = binary.BigEndian.AppendUint32(ranges, intern(data.CountryCode))
+		ranges = binary.BigEndian.AppendUint32(ranges, intern(data.ASName))
+	}
+
+	header := make([]byte, 0, snapshotHeaderSize)
+	header = append(header, snapshotMagic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(order)))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(table)))
+
+	offsets := make([]byte, 0, (len(table)+1)*4)
+	var strs bytes.Buffer
+	for _, s := range table {
+		offsets = binary.BigEndian.AppendUint32(offsets, uint32(strs.Len()))
+		strs.WriteString(s)
+	}
+	offsets = binary.BigEndian.AppendUint32(offsets, uint32(strs.Len()))
+
+	for _, b := range [][]byte{header, ranges, offsets, strs.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/monmohan/traceroute/asn"
+)
+
+const asnUsage = "Usage: tracert asn compile [-lenient] <ip2asn-v4.tsv[.gz]> <snapshot file>"
+
+// runASN implements the asn subcommands, currently only compile.
+func runASN(args []string) {
+	if len(args) < 1 || args[0] != "compile" {
+		fmt.Println(asnUsage)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("asn compile", flag.ExitOnError)
+	lenient := fs.Bool("lenient", false, "Skip malformed rows instead of failing")
+	fs.Parse(args[1:])
+	if fs.NArg() != 2 {
+		fmt.Println(asnUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	query, err := asn.LoadFile(fs.Arg(0), *lenient)
+	if err != nil {
+		fmt.Println("Failed to load dataset:", err)
+		os.Exit(1)
+	}
+	rr, ok := query.(*asn.RangeReader)
+	if !ok {
+		fmt.Printf("%s is already a snapshot\n", fs.Arg(0))
+		os.Exit(1)
+	}
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		fmt.Println("Failed to create snapshot:", err)
+		os.Exit(1)
+	}
+	if err := asn.WriteSnapshot(out, rr); err != nil {
+		out.Close()
+		os.Remove(fs.Arg(1))
+		fmt.Println("Failed to write snapshot:", err)
+		os.Exit(1)
+	}
+	if err := out.Close(); err != nil {
+		fmt.Println("Failed to write snapshot:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Compiled %d ranges into %s", len(rr.ASNData), fs.Arg(1))
+	if rr.Skipped > 0 {
+		fmt.Printf(", skipped %d malformed rows", rr.Skipped)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/trace"
+)
+
+const batchUsage = "Usage: tracert batch [-workers <n>] [-pps <n>] [-out <dir>] [trace flags] <targets file|->"
+
+// target is a line of a targets file
+type target struct {
+	host  string
+	proto string
+	port  int
+}
+
+func (t target) String() string {
+	if t.proto == "tcp" {
+		return fmt.Sprintf("%s tcp/%d", t.host, t.port)
+	}
+	return fmt.Sprintf("%s %s", t.host, t.proto)
+}
+
+/*
+parseTargets reads one target per line: a hostname or IP address, optionally followed by the protocol and the
+port, e.g. "api.example.com tcp 443". Missing ones are taken from proto and port. Blank lines and lines starting
+with # are skipped, the same target listed twice is an error.
+*/
+func parseTargets(r io.Reader, proto string, port int) ([]target, error) {
+	var targets []target
+	seen := make(map[target]int)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <host> [proto] [port]", n)
+		}
+		t := target{host: fields[0], proto: proto, port: port}
+		if len(fields) > 1 {
+			t.proto = fields[1]
+		}
+		if t.proto != "icmp" && t.proto != "tcp" {
+			return nil, fmt.Errorf("line %d: invalid protocol %q", n, t.proto)
+		}
+		if len(fields) > 2 {
+			p, err := strconv.Atoi(fields[2])
+			if err != nil || p < 1 || p > 65535 || t.proto != "tcp" {
+				return nil, fmt.Errorf("line %d: invalid port %q", n, fields[2])
+			}
+			t.port = p
+		}
+		// the port only tells TCP targets apart
+		key := t
+		if key.proto != "tcp" {
+			key.port = 0
+		}
+		if first, ok := seen[key]; ok {
+			return nil, fmt.Errorf("line %d: %s already listed on line %d", n, t, first)
+		}
+		seen[key] = n
+		targets = append(targets, t)
+	}
+	return targets, scanner.Err()
+}
+
+// batchResult is what is written for each target, Error is set instead of Result when it couldn't be traced
+type batchResult struct {
+	Host   string        `json:"host"`
+	Proto  string        `json:"proto"`
+	Port   int           `json:"port,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Result *trace.Result `json:"result,omitempty"`
+}
+
+// fileName is where the result of t goes in the output directory. The host is whatever the targets file says,
+// anything but letters, digits, dots, dashes and colons is replaced so it can't name another directory.
+func (t target) fileName() string {
+	host := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == ':' {
+			return r
+		}
+		return '_'
+	}, t.host)
+	if t.proto == "tcp" {
+		return fmt.Sprintf("%s-tcp-%d.json", host, t.port)
+	}
+	return fmt.Sprintf("%s-%s.json", host, t.proto)
+}
+
+// runBatch implements the batch subcommand, tracing every target of a file with a pool of workers.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	workers := fs.Int("workers", 8, "Number of targets traced at the same time")
+	pps := fs.Int("pps", 0, "Cap on the probes sent per second, across all workers. 0 for no cap")
+	out := fs.String("out", "", "Write each result to <host>-<proto>[-<port>].json in this directory, by default they are printed as JSON lines")
+	newTracer := traceFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println(batchUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *workers < 1 {
+		fmt.Println("Invalid number of workers, setting to default 8")
+		*workers = 8
+	}
+
+	in := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Println("Failed to open targets:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	// stdout is for the results, what setting up the traces prints goes to stderr
+	t := newTracer(os.Stderr)
+	defer t.Close()
+	targets, err := parseTargets(in, t.proto, t.port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read targets:", err)
+		os.Exit(1)
+	}
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create output directory:", err)
+			os.Exit(1)
+		}
+		// hosts that only differ in the characters replaced would share a file
+		files := make(map[string]target)
+		for _, tgt := range targets {
+			if other, ok := files[tgt.fileName()]; ok {
+				fmt.Fprintf(os.Stderr, "Failed to read targets: %s and %s would both be written to %s\n", other, tgt, tgt.fileName())
+				os.Exit(1)
+			}
+			files[tgt.fileName()] = tgt
+		}
+	}
+	t.opts.Pacer = netio.NewPacer(*pps)
+
+	// the progress of concurrent traces interleaves, it is only shown with -verbose
+	if !t.opts.Verbose {
+		t.opts.Out = io.Discard
+	}
+
+	stdout := os.Stdout
+	enc := json.NewEncoder(stdout)
+	reached, failed := 0, 0
+	for r := range t.traceAll(targets, *workers) {
+		tgt := target{host: r.Host, proto: r.Proto, port: r.Port}
+		switch {
+		case r.Error != "":
+			failed++
+		case r.Result.Reached:
+			reached++
+		}
+		if *out == "" {
+			if err := enc.Encode(r); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to encode result:", err)
+			}
+			continue
+		}
+		if err := writeResult(filepath.Join(*out, tgt.fileName()), r); err != nil {
+			fmt.Fprintln(stdout, tgt, "failed to write result:", err)
+			failed++
+			continue
+		}
+		switch {
+		case r.Error != "":
+			fmt.Fprintln(stdout, tgt, "failed:", r.Error)
+		case r.Result.Reached:
+			fmt.Fprintf(stdout, "%s reached in %d hops\n", tgt, r.Result.Hops[len(r.Result.Hops)-1].TTL)
+		default:
+			fmt.Fprintln(stdout, tgt, "not reached")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Traced %d targets: %d reached, %d failed\n", len(targets), reached, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// traceAll traces targets with a pool of workers, the results come as the traces finish
+func (t *tracer) traceAll(targets []target, workers int) <-chan batchResult {
+	jobs := make(chan target)
+	results := make(chan batchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tgt := range jobs {
+				results <- t.batchTrace(tgt)
+			}
+		}()
+	}
+	go func() {
+		for _, tgt := range targets {
+			jobs <- tgt
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// batchTrace traces one target, failures are reported in the result
+func (t *tracer) batchTrace(tgt target) batchResult {
+	r := batchResult{Host: tgt.host, Proto: tgt.proto}
+	if tgt.proto == "tcp" {
+		r.Port = tgt.port
+	}
+	addr, err := net.ResolveIPAddr("ip4", tgt.host)
+	if err != nil {
+		r.Error = fmt.Sprintf("failed to resolve IP address: %v", err)
+		return r
+	}
+	if r.Result, err = t.run(addr, tgt.proto, tgt.port, t.opts); err != nil {
+		r.Error = fmt.Sprintf("trace failed: %v", err)
+		r.Result = nil
+	}
+	return r
+}
+
+func writeResult(path string, r batchResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
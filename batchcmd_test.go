@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	input := `# after the core switch change
+api.example.com tcp 443
+198.51.100.7
+
+db.internal tcp
+10.1.2.3 icmp
+`
+	got, err := parseTargets(strings.NewReader(input), "icmp", 80)
+	if err != nil {
+		t.Fatalf("failed to parse targets: %v", err)
+	}
+	want := []target{
+		{"api.example.com", "tcp", 443},
+		{"198.51.100.7", "icmp", 80},
+		{"db.internal", "tcp", 80},
+		{"10.1.2.3", "icmp", 80},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+	if name := want[0].fileName(); name != "api.example.com-tcp-443.json" {
+		t.Errorf("got: %v, want: %v", name, "api.example.com-tcp-443.json")
+	}
+	if name := (target{"../../etc/x", "icmp", 0}).fileName(); name != ".._.._etc_x-icmp.json" {
+		t.Errorf("got: %v, want: %v", name, ".._.._etc_x-icmp.json")
+	}
+}
+
+func TestParseTargetsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unknown protocol", "example.com udp"},
+		{"port not a number", "example.com tcp https"},
+		{"port out of range", "example.com tcp 70000"},
+		{"port with icmp", "example.com icmp 443"},
+		{"too many fields", "example.com tcp 443 extra"},
+		{"duplicate", "example.com tcp 443\nexample.com\nexample.com tcp 443"},
+		{"duplicate icmp", "example.com\nexample.com icmp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseTargets(strings.NewReader(tt.input), "icmp", 80); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
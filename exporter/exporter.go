@@ -0,0 +1,300 @@
+/*
+Package exporter keeps the metrics of tracert exporter, which traces the same targets over and over, and
+serves them on /metrics in the Prometheus text format. RTT histograms and the counters add up every trace of a
+target, loss ratio, hop count and reachability are those of its last trace.
+*/
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/monmohan/traceroute/trace"
+)
+
+// Buckets are the upper bounds of the RTT histograms, in seconds
+var Buckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// series identifies a traced target, the same host can be traced with both protocols
+type series struct {
+	target string
+	proto  string
+}
+
+// hopKey identifies the RTT histogram of a responder at a TTL
+type hopKey struct {
+	ttl       int
+	responder string
+	asn       string
+}
+
+type histogram struct {
+	// counts are per bucket, the last one is +Inf. They are summed up when written.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(Buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// targetMetrics are the metrics of one series
+type targetMetrics struct {
+	traces      uint64
+	failures    uint64
+	pathChanges uint64
+	rtt         map[hopKey]*histogram
+
+	// from the last trace, loss is nil until one succeeded or after one failed
+	reachable bool
+	hopCount  int
+	loss      map[int]float64
+	// path holds the responders found at each TTL of the last successful trace, nil when none answered.
+	// destination is the TTL the destination answered at, 0 if it didn't.
+	path        map[int]map[string]bool
+	destination int
+}
+
+// Metrics are the metrics of every target traced so far. It is safe for concurrent use.
+type Metrics struct {
+	mu      sync.Mutex
+	targets map[series]*targetMetrics
+}
+
+// New returns Metrics with no target traced yet
+func New() *Metrics {
+	return &Metrics{targets: make(map[series]*targetMetrics)}
+}
+
+func (m *Metrics) get(target, proto string) *targetMetrics {
+	s := series{target, proto}
+	tm := m.targets[s]
+	if tm == nil {
+		tm = &targetMetrics{rtt: make(map[hopKey]*histogram)}
+		m.targets[s] = tm
+	}
+	return tm
+}
+
+/*
+Observe records a trace of target. The path is counted as changed when, at a TTL that answered both this
+time and the last, none of the responders are the same, or when the destination was reached at another TTL.
+Responders that come and go because of loss or load balancing over a few routers don't count as a change.
+*/
+func (m *Metrics) Observe(target, proto string, result *trace.Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tm := m.get(target, proto)
+	tm.traces++
+
+	probes, lost := make(map[int]int), make(map[int]int)
+	path := make(map[int]map[string]bool)
+	hopCount := 0
+	for _, hop := range result.Hops {
+		probes[hop.TTL]++
+		if hop.Addr == nil {
+			lost[hop.TTL]++
+			continue
+		}
+		responder := hop.Addr.String()
+		if path[hop.TTL] == nil {
+			path[hop.TTL] = make(map[string]bool)
+		}
+		path[hop.TTL][responder] = true
+		if hop.TTL > hopCount && (!result.Reached || hop.Destination) {
+			hopCount = hop.TTL
+		}
+
+		key := hopKey{ttl: hop.TTL, responder: responder}
+		if hop.ASN != nil {
+			key.asn = hop.ASN.ASNNumber
+		}
+		h := tm.rtt[key]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(Buckets)+1)}
+			tm.rtt[key] = h
+		}
+		h.observe(hop.RTT.Seconds())
+	}
+
+	destination := 0
+	if result.Reached {
+		destination = hopCount
+	}
+	if tm.path != nil && pathChanged(tm, path, destination) {
+		tm.pathChanges++
+	}
+	tm.reachable, tm.hopCount, tm.path, tm.destination = result.Reached, hopCount, path, destination
+	tm.loss = make(map[int]float64, len(probes))
+	for ttl, n := range probes {
+		tm.loss[ttl] = float64(lost[ttl]) / float64(n)
+	}
+}
+
+// pathChanged compares a new trace with the last one of tm
+func pathChanged(tm *targetMetrics, path map[int]map[string]bool, destination int) bool {
+	if tm.destination != 0 && destination != 0 && tm.destination != destination {
+		return true
+	}
+	for ttl, responders := range path {
+		last := tm.path[ttl]
+		if last == nil {
+			continue
+		}
+		common := false
+		for responder := range responders {
+			common = common || last[responder]
+		}
+		if !common {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ObserveFailure records a trace of target that couldn't be run, e.g. its name didn't resolve. The target
+is reported unreachable and its loss and hop count are dropped until it is traced again, the path of the
+last successful trace is what the next one is compared to.
+*/
+func (m *Metrics) ObserveFailure(target, proto string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tm := m.get(target, proto)
+	tm.traces++
+	tm.failures++
+	tm.reachable, tm.hopCount, tm.loss = false, 0, nil
+}
+
+// metric is the header of a metric family and its samples
+type metric struct {
+	name, help, typ string
+	samples         []string
+}
+
+func (mt *metric) add(name string, labels []string, value float64) {
+	mt.samples = append(mt.samples, fmt.Sprintf("%s{%s} %s", name, strings.Join(labels, ","), formatFloat(value)))
+}
+
+// WriteTo writes every metric in the Prometheus text format, sorted so that successive scrapes line up.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	traces := &metric{name: "tracert_traces_total", help: "Traces run towards the target.", typ: "counter"}
+	failures := &metric{name: "tracert_trace_failures_total", help: "Traces that couldn't be run, e.g. because the target didn't resolve.", typ: "counter"}
+	rtt := &metric{name: "tracert_hop_rtt_seconds", help: "Round trip time of the probes answered at each TTL, by responder.", typ: "histogram"}
+	loss := &metric{name: "tracert_hop_loss_ratio", help: "Share of the probes at each TTL left unanswered in the last trace.", typ: "gauge"}
+	hopCount := &metric{name: "tracert_hop_count", help: "TTL the destination answered at in the last trace, or the highest TTL that answered when it wasn't reached.", typ: "gauge"}
+	reachable := &metric{name: "tracert_destination_reachable", help: "Whether the destination answered in the last trace.", typ: "gauge"}
+	changes := &metric{name: "tracert_path_changes_total", help: "Traces that found another path than the one before.", typ: "counter"}
+
+	m.mu.Lock()
+	all := make([]series, 0, len(m.targets))
+	for s := range m.targets {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].target != all[j].target {
+			return all[i].target < all[j].target
+		}
+		return all[i].proto < all[j].proto
+	})
+	for _, s := range all {
+		tm := m.targets[s]
+		labels := []string{label("target", s.target), label("proto", s.proto)}
+		traces.add(traces.name, labels, float64(tm.traces))
+		failures.add(failures.name, labels, float64(tm.failures))
+		changes.add(changes.name, labels, float64(tm.pathChanges))
+		reachable.add(reachable.name, labels, bool2float(tm.reachable))
+		if tm.loss != nil {
+			hopCount.add(hopCount.name, labels, float64(tm.hopCount))
+			ttls := make([]int, 0, len(tm.loss))
+			for ttl := range tm.loss {
+				ttls = append(ttls, ttl)
+			}
+			sort.Ints(ttls)
+			for _, ttl := range ttls {
+				loss.add(loss.name, append(labels, label("ttl", strconv.Itoa(ttl))), tm.loss[ttl])
+			}
+		}
+
+		keys := make([]hopKey, 0, len(tm.rtt))
+		for k := range tm.rtt {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].ttl != keys[j].ttl {
+				return keys[i].ttl < keys[j].ttl
+			}
+			if keys[i].responder != keys[j].responder {
+				return keys[i].responder < keys[j].responder
+			}
+			return keys[i].asn < keys[j].asn
+		})
+		for _, k := range keys {
+			h := tm.rtt[k]
+			hopLabels := append(labels[:2:2], label("ttl", strconv.Itoa(k.ttl)), label("responder", k.responder), label("asn", k.asn))
+			cumulative := uint64(0)
+			for i, n := range h.counts {
+				cumulative += n
+				le := "+Inf"
+				if i < len(Buckets) {
+					le = formatFloat(Buckets[i])
+				}
+				rtt.add(rtt.name+"_bucket", append(hopLabels[:5:5], label("le", le)), float64(cumulative))
+			}
+			rtt.add(rtt.name+"_sum", hopLabels, h.sum)
+			rtt.add(rtt.name+"_count", hopLabels, float64(h.count))
+		}
+	}
+	m.mu.Unlock()
+
+	var b strings.Builder
+	for _, mt := range []*metric{traces, failures, rtt, loss, hopCount, reachable, changes} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		for _, sample := range mt.samples {
+			b.WriteString(sample)
+			b.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves GET /metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + escaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func bool2float(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package exporter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monmohan/traceroute/asn"
+	"github.com/monmohan/traceroute/trace"
+)
+
+// result is a trace through the given routers, "" for a probe left unanswered. The last one is the destination when reached.
+func result(reached bool, routers ...string) *trace.Result {
+	r := &trace.Result{Target: net.IPv4(93, 184, 216, 34), Proto: "icmp", Reached: reached}
+	for i, addr := range routers {
+		hop := trace.Hop{TTL: i + 1, RTT: time.Duration(i+1) * 4 * time.Millisecond}
+		if addr != "" {
+			hop.Addr = net.ParseIP(addr)
+		}
+		r.Hops = append(r.Hops, hop)
+	}
+	if reached {
+		r.Hops[len(r.Hops)-1].Destination = true
+	}
+	return r
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	return b.String()
+}
+
+func TestObserve(t *testing.T) {
+	m := New()
+	r := result(false, "10.0.0.1", "", "4.69.140.1")
+	r.Hops[2].ASN = &asn.ASNData{ASNNumber: "3356"}
+	// a second query at TTL 2 is answered
+	r.Hops = append(r.Hops, trace.Hop{TTL: 2, Addr: net.ParseIP("10.0.0.2"), RTT: 30 * time.Millisecond})
+	m.Observe("example.com", "icmp", r)
+	m.Observe("example.com:443", "tcp", result(true, "10.0.0.1", "93.184.216.34"))
+
+	got := scrape(t, m)
+	for _, want := range []string{
+		"# TYPE tracert_hop_rtt_seconds histogram\n",
+		`tracert_hop_rtt_seconds_bucket{target="example.com",proto="icmp",ttl="1",responder="10.0.0.1",asn="",le="0.0025"} 0`,
+		`tracert_hop_rtt_seconds_bucket{target="example.com",proto="icmp",ttl="1",responder="10.0.0.1",asn="",le="0.005"} 1`,
+		`tracert_hop_rtt_seconds_bucket{target="example.com",proto="icmp",ttl="1",responder="10.0.0.1",asn="",le="+Inf"} 1`,
+		`tracert_hop_rtt_seconds_sum{target="example.com",proto="icmp",ttl="3",responder="4.69.140.1",asn="3356"} 0.012`,
+		`tracert_hop_rtt_seconds_count{target="example.com",proto="icmp",ttl="2",responder="10.0.0.2",asn=""} 1`,
+		`tracert_hop_loss_ratio{target="example.com",proto="icmp",ttl="2"} 0.5`,
+		`tracert_hop_loss_ratio{target="example.com",proto="icmp",ttl="3"} 0`,
+		`tracert_hop_count{target="example.com",proto="icmp"} 3`,
+		`tracert_hop_count{target="example.com:443",proto="tcp"} 2`,
+		`tracert_destination_reachable{target="example.com",proto="icmp"} 0`,
+		`tracert_destination_reachable{target="example.com:443",proto="tcp"} 1`,
+		`tracert_traces_total{target="example.com",proto="icmp"} 1`,
+		`tracert_path_changes_total{target="example.com",proto="icmp"} 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, `target="example.com",`) > strings.Index(got, `target="example.com:443",`) {
+		t.Error("targets are not sorted")
+	}
+}
+
+func TestPathChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		next   *trace.Result
+		change bool
+	}{
+		{"same path", result(true, "10.0.0.1", "10.0.0.2", "93.184.216.34"), false},
+		{"hop lost", result(true, "10.0.0.1", "", "93.184.216.34"), false},
+		{"router replaced", result(true, "10.0.0.1", "10.0.9.2", "93.184.216.34"), true},
+		{"longer path", result(true, "10.0.0.1", "10.0.0.2", "10.0.0.3", "93.184.216.34"), true},
+		{"destination silent", result(false, "10.0.0.1", "10.0.0.2"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New()
+			m.Observe("example.com", "icmp", result(true, "10.0.0.1", "10.0.0.2", "93.184.216.34"))
+			m.Observe("example.com", "icmp", tt.next)
+			if got := m.targets[series{"example.com", "icmp"}].pathChanges == 1; got != tt.change {
+				t.Errorf("got: %v, want: %v", got, tt.change)
+			}
+		})
+	}
+}
+
+func TestObserveFailure(t *testing.T) {
+	m := New()
+	m.Observe("example.com", "icmp", result(true, "10.0.0.1", "93.184.216.34"))
+	m.ObserveFailure("example.com", "icmp")
+	got := scrape(t, m)
+	for _, want := range []string{
+		`tracert_traces_total{target="example.com",proto="icmp"} 2`,
+		`tracert_trace_failures_total{target="example.com",proto="icmp"} 1`,
+		`tracert_destination_reachable{target="example.com",proto="icmp"} 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "tracert_hop_loss_ratio{") || strings.Contains(got, "tracert_hop_count{") {
+		t.Errorf("last trace failed, yet loss or hop count reported:\n%s", got)
+	}
+
+	// the path is compared to that of the last trace that ran
+	m.Observe("example.com", "icmp", result(true, "10.0.9.1", "93.184.216.34"))
+	if got := m.targets[series{"example.com", "icmp"}].pathChanges; got != 1 {
+		t.Errorf("got: %d path changes, want: 1", got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	if got, want := label("target", `a"b\c`+"\n"), `target="a\"b\\c\n"`; got != want {
+		t.Errorf("got: %s, want: %s", got, want)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	m := New()
+	m.Observe("example.com", "icmp", result(true, "93.184.216.34"))
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/metrics", http.StatusOK},
+		{"/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatalf("failed to get: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got: %d, want: %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+				t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/monmohan/traceroute/exporter"
+	"github.com/monmohan/traceroute/netio"
+)
+
+const exporterUsage = "Usage: tracert exporter [-listen <addr>] [-interval <duration>] [-workers <n>] [-pps <n>] [trace flags] <targets file>"
+
+// runExporter implements the exporter subcommand, tracing the targets of a file every interval and serving
+// the metrics of package exporter for Prometheus to scrape.
+func runExporter(args []string) {
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:9116", "Address to serve /metrics on")
+	interval := fs.Duration("interval", time.Minute, "Time between the starts of two rounds of traces, a round that takes longer delays the next")
+	workers := fs.Int("workers", 8, "Number of targets traced at the same time")
+	pps := fs.Int("pps", 0, "Cap on the probes sent per second, across all workers. 0 for no cap")
+	newTracer := traceFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println(exporterUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *workers < 1 {
+		fmt.Println("Invalid number of workers, setting to default 8")
+		*workers = 8
+	}
+	if *interval <= 0 {
+		fmt.Println("Invalid interval, setting to default 1m")
+		*interval = time.Minute
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Failed to open targets:", err)
+		os.Exit(1)
+	}
+	t := newTracer(os.Stdout)
+	defer t.Close()
+	targets, err := parseTargets(f, t.proto, t.port)
+	f.Close()
+	if err != nil {
+		fmt.Println("Failed to read targets:", err)
+		os.Exit(1)
+	}
+	t.opts.Pacer = netio.NewPacer(*pps)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Println("Failed to listen:", err)
+		os.Exit(1)
+	}
+	metrics := exporter.New()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- http.Serve(ln, metrics)
+	}()
+	fmt.Printf("Tracing %d targets every %v, serving metrics on http://%s/metrics\n", len(targets), *interval, *listen)
+	// the progress of concurrent traces interleaves, it is only shown with -verbose
+	if !t.opts.Verbose {
+		t.opts.Out = io.Discard
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		for r := range t.traceAll(targets, *workers) {
+			name := metricTarget(r)
+			if r.Error != "" {
+				fmt.Println(name, r.Proto, "failed:", r.Error)
+				metrics.ObserveFailure(name, r.Proto)
+				continue
+			}
+			metrics.Observe(name, r.Proto, r.Result)
+		}
+		select {
+		case err := <-errs:
+			fmt.Fprintln(os.Stderr, "Failed to serve:", err)
+			os.Exit(1)
+		case <-ticker.C:
+		}
+	}
+}
+
+// metricTarget is the target label of r, the port is part of it for TCP
+func metricTarget(r batchResult) string {
+	if r.Proto == "tcp" {
+		return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	}
+	return r.Host
+}
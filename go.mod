@@ -7,4 +7,4 @@ require (
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 )
 
-require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+require golang.org/x/sys v0.0.0-20190412213103-97732733099d
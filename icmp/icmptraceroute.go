@@ -2,68 +2,151 @@ package icmp
 
 import (
 	"encoding/binary"
-	"flag"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/monmohan/traceroute/asn"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/pcapng"
+	"github.com/monmohan/traceroute/trace"
+	"github.com/monmohan/traceroute/tracebox"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 )
 
-var dbg bool
-var asnQuery asn.Query
+// probeTimeout is how long to wait for the reply to each probe
+var probeTimeout = 5 * time.Second
 
-func debugPrint(v ...interface{}) {
-	if dbg {
-		fmt.Println(v...)
-	}
+// idOffset keeps the echo IDs of different processes apart, their raw sockets all see every ICMP message
+var idOffset = os.Getpid() & 0xffff
+
+// prober runs one trace, everything it needs is here so traces can run concurrently
+type prober struct {
+	conn   netio.Conn
+	id     int
+	target net.IP
+	opts   trace.Options
 }
 
-func Trace(verbose bool, maxHops int, ipAddr *net.IPAddr) {
-	dbg = verbose
-	flag.Parse()
+func (p *prober) debugPrint(v ...interface{}) {
+	if p.opts.Verbose {
+		fmt.Fprintln(p.opts.Output(), v...)
+	}
+}
 
-	laddr := GetOutboundIP()
-	conn, err := icmp.ListenPacket("ip4:icmp", laddr.String())
+// NewMux opens a raw ICMP socket bound to src with socket applied, to be shared by the traces run with TraceOn.
+func NewMux(src net.IP, socket netio.SocketOptions) (*netio.Mux, error) {
+	conn, err := netio.ListenICMP(src, socket)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
-	defer conn.Close()
-	asnQuery = asn.LoadLocal()
+	return netio.NewMux(conn, 1<<16, demux), nil
+}
 
-	for ttl := 1; ttl <= maxHops; ttl++ {
-		debugPrint("-------------------Start Probe with TTL ", ttl, "-------------------")
+// echoID is the ID of the Echo Requests of the trace holding key
+func echoID(key int) int {
+	return (key + idOffset) & 0xffff
+}
 
-		retAddr, err := runICMPProbe(conn, ipAddr, ttl)
-		if err != nil {
-			fmt.Println(err)
-			continue
+// demux finds the key of the trace an ICMP message belongs to, from its echo ID or that of the Echo Request it quotes
+func demux(datagram []byte) (int, bool) {
+	if len(datagram) < 20 || layers.IPProtocol(datagram[9]) != layers.IPProtocolICMPv4 {
+		return 0, false
+	}
+	msg := datagram[int(datagram[0]&0x0f)*4:]
+	if len(msg) < 8 {
+		return 0, false
+	}
+	id := binary.BigEndian.Uint16(msg[4:6])
+	switch layers.ICMPv4TypeCode(binary.BigEndian.Uint16(msg)).Type() {
+	case layers.ICMPv4TypeEchoReply:
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeTimeExceeded:
+		quoted := msg[8:]
+		if len(quoted) < 20 || layers.IPProtocol(quoted[9]) != layers.IPProtocolICMPv4 {
+			return 0, false
 		}
-
-		if retAddr.String() == ipAddr.IP.String() {
-			break
+		echo := quoted[int(quoted[0]&0x0f)*4:]
+		if len(echo) < 8 || echo[0] != 8 {
+			return 0, false
 		}
-		debugPrint("-------------------End Probe with TTL ", ttl, "-------------------\n")
+		id = binary.BigEndian.Uint16(echo[4:6])
+	default:
+		return 0, false
 	}
+	return (int(id) - idOffset) & 0xffff, true
+}
+
+/*
+Trace runs an ICMP traceroute to ipAddr as set up by opts, on a socket of its own. An error is returned if it
+can't be opened. Probing stops at the destination or once a routing loop is confirmed.
+*/
+func Trace(ipAddr *net.IPAddr, opts trace.Options) (*trace.Result, error) {
+	mux, err := NewMux(opts.Src, opts.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer mux.Close()
+	return TraceOn(mux, ipAddr, opts)
+}
+
+/*
+TraceOn runs an ICMP traceroute to ipAddr through mux, alongside the other traces on it. Its probes carry an
+echo ID of their own, which is how their replies are told apart. opts.Src and opts.Socket must be those mux was
+opened with.
+*/
+func TraceOn(mux *netio.Mux, ipAddr *net.IPAddr, opts trace.Options) (*trace.Result, error) {
+	conn, err := mux.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return traceConn(conn, conn.Key, ipAddr, opts), nil
+}
 
-	fmt.Println("Done..")
+// traceConn probes ipAddr through conn with the echo ID of key, TraceOn runs it on a raw socket shared through a Mux
+func traceConn(conn netio.Conn, key int, ipAddr *net.IPAddr, opts trace.Options) *trace.Result {
+	p := &prober{conn: conn, id: echoID(key), target: ipAddr.IP, opts: opts}
+	result := &trace.Result{Target: ipAddr.IP, Proto: "icmp"}
+	analyzer := trace.NewAnalyzer(ipAddr.IP)
+probing:
+	for ttl := 1; ttl <= opts.MaxHops && !result.Reached; ttl++ {
+		p.debugPrint("-------------------Start Probe with TTL ", ttl, "-------------------")
+
+		for q := 0; q < opts.Queries; q++ {
+			hop, err := p.runICMPProbe(ttl, q)
+			if err != nil {
+				fmt.Fprintln(p.opts.Output(), err)
+				hop = trace.Hop{TTL: ttl}
+			}
+			result.Hops = append(result.Hops, hop)
+			if opts.OnHop != nil {
+				opts.OnHop(hop)
+			}
+			result.Reached = result.Reached || hop.Destination
+			if analyzer.Add(hop) {
+				fmt.Fprintln(p.opts.Output(), "Routing loop detected, stop probing")
+				break probing
+			}
+		}
+		p.debugPrint("-------------------End Probe with TTL ", ttl, "-------------------\n")
+	}
+	result.ASPath = trace.ASPath(result.Hops)
+	result.Anomalies = analyzer.Anomalies()
 
+	fmt.Fprintln(p.opts.Output(), "Done..")
+	return result
 }
 
-func runICMPProbe(conn *icmp.PacketConn, addr *net.IPAddr, ttl int) (net.Addr, error) {
+// runICMPProbe sends the query-th probe with ttl, the sequence number carries both so replies can't be mixed up
+func (p *prober) runICMPProbe(ttl int, query int) (trace.Hop, error) {
+	p.opts.Pacer.Wait()
 	start := time.Now()
-	// Set the TTL for the connection
-	conn.IPv4PacketConn().SetTTL(ttl)
 	echoRequest := &icmp.Echo{
-		ID:   os.Getpid() & 0xffff,
-		Seq:  ttl, //incremented in each iteration
+		ID:   p.id,
+		Seq:  query<<8 | ttl, //TTL in the low byte, query in the high byte
 		Data: []byte("PING.."),
 	}
 
@@ -81,37 +164,66 @@ func runICMPProbe(conn *icmp.PacketConn, addr *net.IPAddr, ttl int) (net.Addr, e
 
 	msg, err := icmpMsg.Marshal(nil)
 	if err != nil {
-		return nil, err
+		return trace.Hop{}, err
 	}
 
-	if _, err = conn.WriteTo(msg, addr); err != nil {
-		return nil, fmt.Errorf("failed to send ICMP message: %v", err)
+	if err = p.conn.Send(p.target, ttl, msg); err != nil {
+		return trace.Hop{}, fmt.Errorf("failed to send ICMP message: %v", err)
 
 	}
-	fmt.Println("Sent ICMP Echo Request with TTL/Seq ", ttl)
+	sentAt := time.Now()
+	fmt.Fprintln(p.opts.Output(), "Sent ICMP Echo Request with TTL/Seq ", ttl, "/", echoRequest.Seq)
+
+	// What the routers should quote back, the kernel fills in the IP ID so it can't be compared.
+	// The copy written to the capture has an ID of 0, which replays take as unknown too.
+	sent := tracebox.Probe{Src: p.conn.LocalAddr(), Dst: p.target, TOS: p.opts.Socket.TOS, Protocol: 1, Transport: msg}
+	if datagram, err := netio.Datagram(sent.Src, sent.Dst, layers.IPProtocolICMPv4, ttl, msg); err == nil {
+		netio.SetTOS(datagram, sent.TOS)
+		p.record(sentAt, datagram, pcapng.ProbeComment(ttl, fmt.Sprintf("seq=%d", echoRequest.Seq)))
+	}
 
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	return readICMPResponse(conn, echoRequest, start)
+	p.conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	return p.readICMPResponse(echoRequest, sent, start)
 
 }
 
-func readICMPResponse(conn *icmp.PacketConn, echoRequest *icmp.Echo, start time.Time) (net.Addr, error) {
-	reply := make([]byte, 1500)
-	n, peer, err := conn.ReadFrom(reply)
-	if err != nil {
-		debugPrint(`failed to receive ICMP reply:`, err)
-		return nil, fmt.Errorf("failed to receive ICMP reply")
+// readICMPResponse waits for the reply to echoRequest. Replies to earlier probes, or to other traces, are skipped.
+func (p *prober) readICMPResponse(echoRequest *icmp.Echo, sent tracebox.Probe, start time.Time) (trace.Hop, error) {
+	for {
+		reply, err := p.conn.Receive()
+		if err != nil {
+			p.debugPrint(`failed to receive ICMP reply:`, err)
+			return trace.Hop{}, fmt.Errorf("failed to receive ICMP reply")
 
+		}
+		if hop, ok := p.matchReply(reply, echoRequest, sent, start); ok {
+			return hop, nil
+		}
+	}
+}
+
+// matchReply builds the hop for reply, false if it doesn't answer echoRequest
+func (p *prober) matchReply(reply netio.Packet, echoRequest *icmp.Echo, sent tracebox.Probe, start time.Time) (trace.Hop, bool) {
+	at := reply.At
+	hop := trace.Hop{TTL: echoRequest.Seq & 0xff, RTT: at.Sub(start)}
+	// what to write to the capture file once the reply is known to match the probe
+	matched := func() {
+		p.record(at, reply.Data, pcapng.ReplyComment(hop.TTL, fmt.Sprintf("seq=%d", echoRequest.Seq)))
 	}
 
-	packet := gopacket.NewPacket(reply[:n], layers.LayerTypeICMPv4, gopacket.Default)
+	packet := gopacket.NewPacket(reply.Data, layers.LayerTypeIPv4, gopacket.Default)
+	ip4, _ := packet.NetworkLayer().(*layers.IPv4)
 	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
-	if icmpLayer == nil {
-		return nil, fmt.Errorf("failed to parse ICMP reply")
+	if ip4 == nil || icmpLayer == nil {
+		p.debugPrint("IGNORE: failed to parse ICMP reply")
+		return hop, false
 
 	}
+	peer := ip4.SrcIP
+	hop.Addr = peer
+	hop.ReplyTTL = int(ip4.TTL)
 	icmpPacket, _ := icmpLayer.(*layers.ICMPv4)
-	debugPrint("Reply from : ", peer)
+	p.debugPrint("Reply from : ", peer)
 	/**
 
 		 RFC 792
@@ -131,72 +243,105 @@ func readICMPResponse(conn *icmp.PacketConn, echoRequest *icmp.Echo, start time.
 
 	switch icmpPacket.TypeCode.Type() {
 	case layers.ICMPv4TypeEchoReply:
-		fmt.Println("Echo reply from peer ", peer)
 		// For Echo Reply, ID and Seq are directly available in the ICMP header
-		if icmpPacket.Id == uint16(echoRequest.ID) && icmpPacket.Seq == uint16(echoRequest.Seq) {
-			debugPrint("Found original message in Echo Reply, ID and Sequence match\n")
-			fmt.Println("Time taken: ", time.Since(start))
-		} else {
-			fmt.Println("IGNORE: Echo Reply does not match original message")
+		if !peer.Equal(sent.Dst) || icmpPacket.Id != uint16(echoRequest.ID) || icmpPacket.Seq != uint16(echoRequest.Seq) {
+			p.debugPrint("IGNORE: Echo Reply does not match original message")
+			return hop, false
 		}
-
-	case layers.ICMPv4TypeDestinationUnreachable:
-		debugPrint("Destination unreachable")
-	case layers.ICMPv4TypeTimeExceeded:
-		fmt.Println("ICMP Time exceeded resopnse from ", peer)
-
-		if len(icmpPacket.Payload) >= 28 { // 20 bytes IP header + 8 bytes original ICMP header
-			// Get the IP header length
-			ipHeaderLength := int(icmpPacket.Payload[0]&0x0f) * 4
-			debugPrint("IP Header Length: ", ipHeaderLength)
-
-			originalICMP := icmpPacket.Payload[ipHeaderLength:] // Skip the IP header
-			// 8 is the type for Echo Request
-			if originalICMP[0] == 8 {
-				/*
-					Network byte order is, by convention, big-endian. RFC 1700
-				*/
-				code := originalICMP[1] //should be 0
-				checksum := binary.BigEndian.Uint16(originalICMP[2:4])
-				id := binary.BigEndian.Uint16(originalICMP[4:6])
-				seq := binary.BigEndian.Uint16(originalICMP[6:8])
-				debugPrint(fmt.Sprintf("Data read from ICMP Response => Code: %d, Checksum: %d, ID: %d, Sequence: %d", code, checksum, id, seq))
-				if id == uint16(echoRequest.ID) && seq == uint16(echoRequest.Seq) {
-					debugPrint(fmt.Sprintf("Found original message in Time Exceeded payload, ID %d and Sequence %d match\n ", id, seq))
-					fmt.Println("Duration: ", time.Since(start))
-				} else {
-					fmt.Println("IGNORE: Time Exceeded payload does not match original message")
-				}
-				asndata, err := asnQuery.FindASN(peer.String())
-				if err != nil {
-					fmt.Println("Failed to find ASN: ", err)
-				} else {
-					fmt.Println("ASN: ", asndata.ASNNumber, " ", asndata.ASName, " ", asndata.CountryCode)
-				}
-
-			} else {
-				fmt.Println("Original message was not an Echo Request")
-			}
+		fmt.Fprintln(p.opts.Output(), "Echo reply from peer ", peer)
+		p.debugPrint("Found original message in Echo Reply, ID and Sequence match\n")
+		fmt.Fprintln(p.opts.Output(), "Time taken: ", time.Since(start))
+		hop.Destination = true
+		matched()
+		p.annotateHop(&hop)
+
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeTimeExceeded:
+		if !p.quotes(icmpPacket.Payload, echoRequest, sent) {
+			return hop, false
+		}
+		if icmpPacket.TypeCode.Type() == layers.ICMPv4TypeTimeExceeded {
+			fmt.Fprintln(p.opts.Output(), "ICMP Time exceeded resopnse from ", peer)
+			sent.Expired = true
 		} else {
-			fmt.Println("Time Exceeded payload too short to extract original message")
+			p.debugPrint("Destination unreachable")
+			// the target refusing the probe still ends the trace, routers doing so don't
+			hop.Destination = hop.Addr.Equal(sent.Dst)
+		}
+		// RFC 4884 extensions can follow the quote of either error
+		if err := hop.AddExtensions(ip4.Payload); err != nil {
+			p.debugPrint("Failed to parse ICMP extensions: ", err)
 		}
+		fmt.Fprintln(p.opts.Output(), "Duration: ", time.Since(start))
+		hop.CompareQuote(sent, icmpPacket.Payload)
+		matched()
+		p.annotateHop(&hop)
 
 	default:
-		debugPrint("Unknown")
+		p.debugPrint("IGNORE: Unknown")
+		return hop, false
 	}
 
-	return peer, nil
+	return hop, true
 
 }
 
-func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
+// quotes reports whether the payload of an ICMP error is echoRequest, as sent to the target of this trace
+func (p *prober) quotes(payload []byte, echoRequest *icmp.Echo, sent tracebox.Probe) bool {
+	if len(payload) < 28 { // 20 bytes IP header + 8 bytes original ICMP header
+		p.debugPrint("IGNORE: ICMP payload too short to extract original message")
+		return false
 	}
-	defer conn.Close()
+	// Get the IP header length
+	ipHeaderLength := int(payload[0]&0x0f) * 4
+	p.debugPrint("IP Header Length: ", ipHeaderLength)
+	if len(payload) < ipHeaderLength+8 {
+		p.debugPrint("IGNORE: ICMP payload too short to extract original message")
+		return false
+	}
+
+	originalICMP := payload[ipHeaderLength:] // Skip the IP header
+	// 8 is the type for Echo Request
+	if originalICMP[0] != 8 {
+		p.debugPrint("IGNORE: Original message was not an Echo Request")
+		return false
+	}
+	/*
+		Network byte order is, by convention, big-endian. RFC 1700
+	*/
+	code := originalICMP[1] //should be 0
+	checksum := binary.BigEndian.Uint16(originalICMP[2:4])
+	id := binary.BigEndian.Uint16(originalICMP[4:6])
+	seq := binary.BigEndian.Uint16(originalICMP[6:8])
+	p.debugPrint(fmt.Sprintf("Data read from ICMP Response => Code: %d, Checksum: %d, ID: %d, Sequence: %d", code, checksum, id, seq))
+	// traces in other processes may have picked the same ID, only the destination tells their probes apart
+	if !net.IP(payload[16:20]).Equal(sent.Dst) || id != uint16(echoRequest.ID) || seq != uint16(echoRequest.Seq) {
+		p.debugPrint("IGNORE: ICMP payload does not match original message")
+		return false
+	}
+	p.debugPrint(fmt.Sprintf("Found original message in ICMP payload, ID %d and Sequence %d match\n ", id, seq))
+	return true
+}
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+// annotateHop looks up the ASN of the responding peer and prints it
+func (p *prober) annotateHop(hop *trace.Hop) {
+	if err := hop.Annotate(p.opts.ASN); err != nil {
+		fmt.Fprintln(p.opts.Output(), "Failed to find ASN: ", err)
+	}
+	hop.InferReturnPath()
+	out := p.opts.Output()
+	hop.PrintASN(out)
+	hop.PrintReturnPath(out)
+	hop.PrintExtensions(out)
+	hop.PrintMarking(out)
+	hop.PrintModifications(out)
+}
 
-	return localAddr.IP
+// record writes a datagram to the capture file, if there is one
+func (p *prober) record(at time.Time, datagram []byte, comment string) {
+	if p.opts.Capture == nil {
+		return
+	}
+	if err := p.opts.Capture.WritePacket(at, datagram, comment); err != nil {
+		fmt.Fprintln(p.opts.Output(), "Failed to write capture: ", err)
+	}
 }
@@ -0,0 +1,323 @@
+package icmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/monmohan/traceroute/icmpext"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/netsim"
+	"github.com/monmohan/traceroute/pcapng"
+	"github.com/monmohan/traceroute/replay"
+	"github.com/monmohan/traceroute/trace"
+	"github.com/monmohan/traceroute/tracebox"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+var (
+	local  = net.IPv4(192, 168, 1, 10).To4()
+	target = net.IPv4(93, 184, 216, 34).To4()
+)
+
+func TestTraceConn(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	n := &netsim.Network{
+		Local: local,
+		Routers: []netsim.Router{
+			{Addr: net.IPv4(192, 168, 1, 1), Latency: time.Millisecond},
+			{Addr: net.IPv4(10, 0, 0, 1), Silent: true},
+			{Addr: net.IPv4(10, 0, 1, 1), Latency: 5 * time.Millisecond, MPLS: []icmpext.MPLSLabel{{Label: 24001, S: true, TTL: 1}}},
+		},
+		Target: netsim.Host{Addr: target, Latency: 8 * time.Millisecond},
+	}
+	conn := n.Conn(layers.IPProtocolICMPv4)
+	defer conn.Close()
+
+	result := traceConn(conn, 0, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 1})
+	if !result.Reached {
+		t.Fatal("trace did not reach the target")
+	}
+	want := []struct {
+		addr       net.IP
+		latency    time.Duration
+		returnHops int
+	}{
+		{net.IPv4(192, 168, 1, 1), time.Millisecond, 1},
+		{nil, 0, 0},
+		{net.IPv4(10, 0, 1, 1), 5 * time.Millisecond, 3},
+		{target, 8 * time.Millisecond, 4},
+	}
+	if len(result.Hops) != len(want) {
+		t.Fatalf("got %d hops, want %d", len(result.Hops), len(want))
+	}
+	for i, h := range result.Hops {
+		w := want[i]
+		if h.TTL != i+1 || !h.Addr.Equal(w.addr) || h.RTT < w.latency || h.ReturnHops != w.returnHops {
+			t.Errorf("hop %d: got: %d %v %v %d hops back, want: %d %v >=%v %d hops back", i,
+				h.TTL, h.Addr, h.RTT, h.ReturnHops, i+1, w.addr, w.latency, w.returnHops)
+		}
+		if len(h.Modifications) != 0 {
+			t.Errorf("hop %d: unexpected modifications %v", i, h.Modifications)
+		}
+	}
+	if mpls := result.Hops[2].MPLS; len(mpls) != 1 || mpls[0].Label != 24001 {
+		t.Errorf("got: %v, want: label 24001", mpls)
+	}
+	if !result.Hops[3].Destination {
+		t.Error("last hop is not the destination")
+	}
+}
+
+func TestTraceConnECMP(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	n := &netsim.Network{
+		Local: local,
+		Routers: []netsim.Router{
+			{Addr: net.IPv4(192, 168, 1, 1)},
+			{Addr: net.IPv4(10, 0, 0, 1), ECMP: []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}},
+			{Addr: net.IPv4(10, 0, 1, 1)},
+		},
+		Target: netsim.Host{Addr: target},
+	}
+	conn := n.Conn(layers.IPProtocolICMPv4)
+	defer conn.Close()
+
+	// every Echo Request is a new flow, so the queries spread over the siblings
+	result := traceConn(conn, 0, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 6})
+	seen := map[string]bool{}
+	for _, h := range result.Hops {
+		if h.TTL == 2 && h.Addr != nil {
+			seen[h.Addr.String()] = true
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("got responders %v at TTL 2, want more than one", seen)
+	}
+	if len(result.Anomalies) == 0 {
+		t.Error("expected the load balanced hop to be reported")
+	}
+}
+
+func TestTraceConnMarking(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	bleached := uint8(0)
+	n := &netsim.Network{
+		Local: local,
+		Routers: []netsim.Router{
+			{Addr: net.IPv4(192, 168, 1, 1)},
+			{Addr: net.IPv4(10, 0, 0, 1), Remark: &bleached},
+			{Addr: net.IPv4(10, 0, 1, 1)},
+		},
+		Target: netsim.Host{Addr: target},
+	}
+	conn := n.Conn(layers.IPProtocolICMPv4)
+	conn.TOS = 0xb8
+	defer conn.Close()
+
+	result := traceConn(conn, 0, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 1, Socket: netio.SocketOptions{TOS: 0xb8}})
+	if len(result.Hops) != 4 {
+		t.Fatalf("got %d hops, want 4", len(result.Hops))
+	}
+	// the second router bleaches what it forwards, so only the third hop sees it
+	for i, survived := range []bool{true, true, false} {
+		m := result.Hops[i].Marking
+		if m == nil || m.Survived() != survived || m.SentDSCP != 46 {
+			t.Errorf("hop %d: got: %v, want: EF survived %v", i, m, survived)
+		}
+	}
+	if m := result.Hops[2].Marking; m != nil && m.DSCP != 0 {
+		t.Errorf("got: %v, want: DSCP bleached to 0", m)
+	}
+	if result.Hops[3].Marking != nil {
+		t.Error("the Echo Reply quotes nothing, the destination has no marking")
+	}
+}
+
+// sharedConn also receives the replies to the same probes sent by a trace in another process, raw sockets all see every ICMP message
+type sharedConn struct {
+	*netsim.Conn
+	other *netsim.Network
+	stray []netio.Packet
+}
+
+func (c *sharedConn) Send(dst net.IP, ttl int, payload []byte) error {
+	// the other trace picked our echo ID and sends the same sequence numbers, its replies come in first
+	if datagram, err := netio.Datagram(local, c.other.Target.Addr, layers.IPProtocolICMPv4, ttl, payload); err == nil {
+		if reply, at, ok := c.other.Respond(datagram, time.Now()); ok {
+			c.stray = append(c.stray, netio.Packet{Data: reply, At: at})
+		}
+	}
+	return c.Conn.Send(dst, ttl, payload)
+}
+
+func (c *sharedConn) Receive() (netio.Packet, error) {
+	if len(c.stray) > 0 {
+		p := c.stray[0]
+		c.stray = c.stray[1:]
+		return p, nil
+	}
+	return c.Conn.Receive()
+}
+
+func TestTraceConnSharedSocket(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	n := &netsim.Network{
+		Local:   local,
+		Routers: []netsim.Router{{Addr: net.IPv4(192, 168, 1, 1)}, {Addr: net.IPv4(10, 0, 0, 1)}},
+		Target:  netsim.Host{Addr: target},
+	}
+	other := &netsim.Network{
+		Local:   local,
+		Routers: []netsim.Router{{Addr: net.IPv4(172, 16, 0, 1)}, {Addr: net.IPv4(172, 16, 1, 1)}},
+		Target:  netsim.Host{Addr: net.IPv4(198, 51, 100, 7).To4()},
+	}
+	conn := &sharedConn{Conn: n.Conn(layers.IPProtocolICMPv4), other: other}
+	defer conn.Close()
+
+	result := traceConn(conn, 0, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 1})
+	want := []net.IP{net.IPv4(192, 168, 1, 1), net.IPv4(10, 0, 0, 1), target}
+	if len(result.Hops) != len(want) {
+		t.Fatalf("got %d hops, want %d", len(result.Hops), len(want))
+	}
+	for i, h := range result.Hops {
+		if !h.Addr.Equal(want[i]) {
+			t.Errorf("hop %d: got: %v, want: %v", i, h.Addr, want[i])
+		}
+	}
+}
+
+func TestTraceOn(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	n := &netsim.Network{
+		Local: local,
+		Routers: []netsim.Router{
+			{Addr: net.IPv4(192, 168, 1, 1), Latency: time.Millisecond},
+			{Addr: net.IPv4(10, 0, 0, 1), Latency: 2 * time.Millisecond},
+			{Addr: net.IPv4(10, 0, 1, 1), Latency: 3 * time.Millisecond},
+		},
+		Target: netsim.Host{Addr: target, Latency: 4 * time.Millisecond},
+	}
+	mux := netio.NewMux(n.Conn(layers.IPProtocolICMPv4), 1<<16, demux)
+	defer mux.Close()
+
+	// the traces send the same sequence numbers to the same target at the same time, only the echo ID differs
+	results := make(chan *trace.Result, 3)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			result, err := TraceOn(mux, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 1})
+			if err != nil {
+				t.Errorf("failed to trace: %v", err)
+			}
+			results <- result
+		}()
+	}
+	for i := 0; i < cap(results); i++ {
+		result := <-results
+		if result == nil {
+			continue
+		}
+		if !result.Reached || len(result.Hops) != 4 {
+			t.Fatalf("got %d hops reached %v, want 4 hops reached", len(result.Hops), result.Reached)
+		}
+		for j, h := range result.Hops {
+			if h.Addr == nil {
+				t.Errorf("hop %d lost, its reply went to another trace", j)
+			}
+		}
+	}
+}
+
+func TestMatchReplyUnreachable(t *testing.T) {
+	n := &netsim.Network{
+		Local:   local,
+		Routers: []netsim.Router{{Addr: net.IPv4(10, 0, 1, 1), MPLS: []icmpext.MPLSLabel{{Label: 24001, S: true, TTL: 1}}}},
+		Target:  netsim.Host{Addr: target},
+	}
+	echo := &icmp.Echo{ID: 7, Seq: 1, Data: []byte("PING..")}
+	msg, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: echo}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal echo: %v", err)
+	}
+	datagram, err := netio.Datagram(local, target, layers.IPProtocolICMPv4, 1, msg)
+	if err != nil {
+		t.Fatalf("failed to build probe: %v", err)
+	}
+	start := time.Now()
+	reply, at, ok := n.Respond(datagram, start)
+	if !ok {
+		t.Fatal("no reply from the router")
+	}
+	// the router refuses the probe instead of letting it expire, with the same quote and extensions
+	reply[20], reply[21] = 3, 13
+
+	p := &prober{id: 7, target: target}
+	sent := tracebox.Probe{Src: local, Dst: target, Protocol: 1, Transport: msg}
+	hop, ok := p.matchReply(netio.Packet{Data: reply, At: at}, echo, sent, start)
+	if !ok {
+		t.Fatal("Destination Unreachable not matched to the probe")
+	}
+	if hop.Destination {
+		t.Error("a router refusing the probe is not the destination")
+	}
+	if len(hop.MPLS) != 1 || hop.MPLS[0].Label != 24001 {
+		t.Errorf("got: %v, want: label 24001", hop.MPLS)
+	}
+	if hop.ReturnHops != 1 {
+		t.Errorf("got: %d hops back, want: 1", hop.ReturnHops)
+	}
+	if len(hop.Modifications) != 0 {
+		t.Errorf("unexpected modifications %v", hop.Modifications)
+	}
+}
+
+func TestTraceConnCaptureReplay(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 100 * time.Millisecond
+
+	n := &netsim.Network{
+		Local:   local,
+		Routers: []netsim.Router{{Addr: net.IPv4(192, 168, 1, 1)}, {Addr: net.IPv4(10, 0, 0, 1)}},
+		Target:  netsim.Host{Addr: target},
+	}
+	conn := n.Conn(layers.IPProtocolICMPv4)
+	// the kernel picks the IP ID, the probes written to the capture don't know it
+	conn.IPID = 0x4d2
+	defer conn.Close()
+
+	var capture bytes.Buffer
+	w, err := pcapng.NewWriter(&capture)
+	if err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	traced := traceConn(conn, 0, &net.IPAddr{IP: target}, trace.Options{MaxHops: 10, Queries: 1, Capture: w})
+
+	results, err := replay.Replay(&capture, replay.Options{Target: target})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(results) != 1 || len(results[0].Hops) != len(traced.Hops) || !results[0].Reached {
+		t.Fatalf("got: %+v, want the %d hops traced", results, len(traced.Hops))
+	}
+	for i, h := range results[0].Hops {
+		if !h.Addr.Equal(traced.Hops[i].Addr) {
+			t.Errorf("hop %d: got: %v, want: %v", i, h.Addr, traced.Hops[i].Addr)
+		}
+		if len(h.Modifications) != 0 {
+			t.Errorf("hop %d: unexpected modifications %v", i, h.Modifications)
+		}
+	}
+}
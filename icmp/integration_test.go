@@ -0,0 +1,99 @@
+//go:build integration && linux
+
+package icmp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/monmohan/traceroute/netns"
+	"github.com/monmohan/traceroute/trace"
+)
+
+// buildChain builds topology for the test, skipping it where namespaces or netem can't be set up
+func buildChain(t *testing.T, topology netns.Topology) *netns.Chain {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	chain, err := netns.Build(topology)
+	if errors.Is(err, netns.ErrNetem) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("failed to build topology: %v", err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+func traceChain(t *testing.T, chain *netns.Chain, maxHops int) *trace.Result {
+	var result *trace.Result
+	err := chain.InProber(func() error {
+		var err error
+		result, err = Trace(&net.IPAddr{IP: chain.Target}, trace.Options{MaxHops: maxHops, Queries: 1, Src: chain.Source})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to trace from the prober namespace: %v", err)
+	}
+	return result
+}
+
+func TestTraceNetns(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology netns.Topology
+	}{
+		{"plain chain", netns.Topology{Routers: make([]netns.Link, 3)}},
+		{"delayed links", netns.Topology{
+			Routers: []netns.Link{{Delay: 10 * time.Millisecond}, {}, {Delay: 20 * time.Millisecond}},
+			Target:  netns.Link{Delay: 5 * time.Millisecond},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := buildChain(t, tt.topology)
+			result := traceChain(t, chain, 10)
+			if !result.Reached {
+				t.Fatal("trace did not reach the target")
+			}
+			want := append(append([]net.IP(nil), chain.Routers...), chain.Target)
+			if len(result.Hops) != len(want) {
+				t.Fatalf("got %d hops, want %d", len(result.Hops), len(want))
+			}
+			// replies are delayed on every link on their way back
+			links := append(append([]netns.Link(nil), tt.topology.Routers...), tt.topology.Target)
+			var minRTT time.Duration
+			for i, h := range result.Hops {
+				minRTT += links[i].Delay
+				if h.TTL != i+1 || !h.Addr.Equal(want[i]) {
+					t.Errorf("hop %d: got: %d %v, want: %d %v", i, h.TTL, h.Addr, i+1, want[i])
+				}
+				if h.RTT < minRTT || h.RTT > minRTT+time.Second {
+					t.Errorf("hop %d: got: %v, want: between %v and %v", i, h.RTT, minRTT, minRTT+time.Second)
+				}
+			}
+			if !result.Hops[len(want)-1].Destination {
+				t.Error("last hop is not the destination")
+			}
+		})
+	}
+}
+
+func TestTraceNetnsLoss(t *testing.T) {
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = 500 * time.Millisecond
+
+	// the routers answer, the target's replies are all lost
+	chain := buildChain(t, netns.Topology{Routers: make([]netns.Link, 2), Target: netns.Link{Loss: 1}})
+	result := traceChain(t, chain, 4)
+	if result.Reached {
+		t.Error("trace reached a target whose replies are lost")
+	}
+	if len(result.Hops) != 4 || !result.Hops[1].Addr.Equal(chain.Routers[1]) || result.Hops[2].Addr != nil {
+		t.Errorf("unexpected hops: %+v", result.Hops)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Package icmpext parses the multi-part extensions routers append to ICMP error messages (RFC 4884),
+such as the MPLS label stack of RFC 4950 and the interface information of RFC 5837.
+
+	0                   1                   2                   3
+	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|     Type      |     Code      |          Checksum             |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|     unused    |    Length     |          unused               |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|      Internet Header + leading octets of original datagram    |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|Version|       (Reserved)      |           Checksum            |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|             Length            |   Class-Num   |   C-Type      |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	|                    Object payload ...                         |
+	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+Length counts the original datagram in 32 bit words. Routers predating RFC 4884 leave it zero
+but still pad the original datagram to 128 bytes, so that offset is tried when Length is unset.
+*/
+package icmpext
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	icmpHeaderLength = 8
+	// minOriginalLength is the least the original datagram field is padded to when extensions follow
+	minOriginalLength = 128
+	extensionVersion  = 2
+)
+
+// Object classes
+const (
+	ClassMPLS          = 1
+	ClassInterfaceInfo = 2
+)
+
+// ICMPv4 types that may carry extensions
+const (
+	typeDestinationUnreachable = 3
+	typeTimeExceeded           = 11
+	typeParameterProblem       = 12
+)
+
+// MPLSLabel is one entry of an MPLS label stack (RFC 4950).
+type MPLSLabel struct {
+	Label uint32 `json:"label"`
+	TC    uint8  `json:"tc"`
+	S     bool   `json:"s"`
+	TTL   uint8  `json:"ttl"`
+}
+
+func (l MPLSLabel) String() string {
+	s := 0
+	if l.S {
+		s = 1
+	}
+	return fmt.Sprintf("Label=%d TC/EXP=%d S=%d TTL=%d", l.Label, l.TC, s, l.TTL)
+}
+
+// InterfaceRole tells which interface of the router an InterfaceInfo describes.
+type InterfaceRole uint8
+
+const (
+	RoleIncoming InterfaceRole = iota
+	RoleSubIP
+	RoleOutgoing
+	RoleNextHop
+)
+
+func (r InterfaceRole) String() string {
+	switch r {
+	case RoleIncoming:
+		return "incoming"
+	case RoleSubIP:
+		return "sub-ip"
+	case RoleOutgoing:
+		return "outgoing"
+	default:
+		return "next-hop"
+	}
+}
+
+func (r InterfaceRole) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+/*
+InterfaceInfo is an Interface Information Object (RFC 5837). Fields the router did not include are zero.
+The C-Type of the object tells the role and which fields follow, in this order:
+
+	bit 0-1  role   bit 4  ifIndex   bit 5  IP address   bit 6  name   bit 7  MTU
+*/
+type InterfaceInfo struct {
+	Role    InterfaceRole `json:"role"`
+	IfIndex uint32        `json:"ifindex,omitempty"`
+	Addr    net.IP        `json:"addr,omitempty"`
+	Name    string        `json:"name,omitempty"`
+	MTU     uint32        `json:"mtu,omitempty"`
+}
+
+func (i InterfaceInfo) String() string {
+	s := fmt.Sprintf("%s interface", i.Role)
+	if i.Name != "" {
+		s += " " + i.Name
+	}
+	if i.Addr != nil {
+		s += " " + i.Addr.String()
+	}
+	if i.MTU != 0 {
+		s += fmt.Sprintf(" MTU=%d", i.MTU)
+	}
+	if i.IfIndex != 0 {
+		s += fmt.Sprintf(" ifIndex=%d", i.IfIndex)
+	}
+	return s
+}
+
+// C-Type flags of an Interface Information Object
+const (
+	ifInfoIndex = 0x08
+	ifInfoAddr  = 0x04
+	ifInfoName  = 0x02
+	ifInfoMTU   = 0x01
+)
+
+// Address family identifiers of the IP Address Sub-Object
+const (
+	afiIPv4 = 1
+	afiIPv6 = 2
+)
+
+// Object is an extension object as found on the wire.
+type Object struct {
+	Class   uint8
+	CType   uint8
+	Payload []byte
+}
+
+// Extensions holds the decoded extension objects of one ICMP message.
+type Extensions struct {
+	MPLS       []MPLSLabel
+	Interfaces []InterfaceInfo
+	Objects    []Object
+}
+
+// ParseMessage parses the extensions of an ICMPv4 message, header included.
+// It returns nil when the message is not an error message or carries no extensions.
+func ParseMessage(msg []byte) (*Extensions, error) {
+	if len(msg) < icmpHeaderLength {
+		return nil, nil
+	}
+	switch msg[0] {
+	case typeDestinationUnreachable, typeTimeExceeded, typeParameterProblem:
+	default:
+		return nil, nil
+	}
+	return Parse(msg[icmpHeaderLength:], int(msg[5]))
+}
+
+// Parse parses the extension structure following the original datagram in body, the ICMP message after its header.
+// length is the RFC 4884 length field, in 32 bit words.
+func Parse(body []byte, length int) (*Extensions, error) {
+	compliant := length > 0
+	start := length * 4
+	if !compliant {
+		start = minOriginalLength
+	}
+	if len(body) < start+4 {
+		return nil, nil
+	}
+	ext := body[start:]
+	if ext[0]>>4 != extensionVersion {
+		if compliant {
+			return nil, fmt.Errorf("unsupported ICMP extension version %d", ext[0]>>4)
+		}
+		// Just a long original datagram, not an extension structure
+		return nil, nil
+	}
+	if cksum := binary.BigEndian.Uint16(ext[2:4]); cksum != 0 && checksum(ext) != 0 {
+		if compliant {
+			return nil, errors.New("invalid ICMP extension checksum")
+		}
+		return nil, nil
+	}
+
+	exts := &Extensions{}
+	for off := 4; off < len(ext); {
+		if len(ext)-off < 4 {
+			return exts, errors.New("truncated ICMP extension object header")
+		}
+		objLen := int(binary.BigEndian.Uint16(ext[off:]))
+		if objLen < 4 || off+objLen > len(ext) {
+			return exts, fmt.Errorf("invalid ICMP extension object length %d", objLen)
+		}
+		obj := Object{Class: ext[off+2], CType: ext[off+3], Payload: ext[off+4 : off+objLen]}
+		exts.Objects = append(exts.Objects, obj)
+		if err := exts.decode(obj); err != nil {
+			return exts, err
+		}
+		off += objLen
+	}
+	return exts, nil
+}
+
+func (e *Extensions) decode(obj Object) error {
+	switch {
+	case obj.Class == ClassMPLS && obj.CType == 1:
+		if len(obj.Payload)%4 != 0 {
+			return fmt.Errorf("invalid MPLS label stack length %d", len(obj.Payload))
+		}
+		for i := 0; i < len(obj.Payload); i += 4 {
+			entry := binary.BigEndian.Uint32(obj.Payload[i:])
+			e.MPLS = append(e.MPLS, MPLSLabel{
+				Label: entry >> 12,
+				TC:    uint8(entry>>9) & 0x7,
+				S:     entry>>8&1 == 1,
+				TTL:   uint8(entry),
+			})
+		}
+	case obj.Class == ClassInterfaceInfo:
+		info, err := parseInterfaceInfo(obj)
+		if err != nil {
+			return err
+		}
+		e.Interfaces = append(e.Interfaces, info)
+	}
+	return nil
+}
+
+func parseInterfaceInfo(obj Object) (InterfaceInfo, error) {
+	info := InterfaceInfo{Role: InterfaceRole(obj.CType >> 6)}
+	p := obj.Payload
+	truncated := errors.New("truncated interface information object")
+
+	if obj.CType&ifInfoIndex != 0 {
+		if len(p) < 4 {
+			return info, truncated
+		}
+		info.IfIndex = binary.BigEndian.Uint32(p)
+		p = p[4:]
+	}
+	if obj.CType&ifInfoAddr != 0 {
+		if len(p) < 4 {
+			return info, truncated
+		}
+		size := 0
+		switch binary.BigEndian.Uint16(p) {
+		case afiIPv4:
+			size = net.IPv4len
+		case afiIPv6:
+			size = net.IPv6len
+		default:
+			return info, fmt.Errorf("unknown address family %d in interface information", binary.BigEndian.Uint16(p))
+		}
+		if len(p) < 4+size {
+			return info, truncated
+		}
+		info.Addr = append(net.IP(nil), p[4:4+size]...)
+		p = p[4+size:]
+	}
+	if obj.CType&ifInfoName != 0 {
+		if len(p) < 1 || int(p[0]) > len(p) || p[0] == 0 {
+			return info, truncated
+		}
+		// The length octet counts itself, the name is NUL padded to a multiple of 4
+		name := p[1:p[0]]
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		info.Name = string(name)
+		p = p[p[0]:]
+	}
+	if obj.CType&ifInfoMTU != 0 {
+		if len(p) < 4 {
+			return info, truncated
+		}
+		info.MTU = binary.BigEndian.Uint32(p)
+	}
+	return info, nil
+}
+
+// checksum is the Internet checksum of b, zero when b includes a valid checksum.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// MPLSObject encodes a label stack as an extension object.
+func MPLSObject(labels []MPLSLabel) Object {
+	payload := make([]byte, 0, 4*len(labels))
+	for _, l := range labels {
+		entry := l.Label<<12 | uint32(l.TC&0x7)<<9 | uint32(l.TTL)
+		if l.S {
+			entry |= 1 << 8
+		}
+		payload = binary.BigEndian.AppendUint32(payload, entry)
+	}
+	return Object{Class: ClassMPLS, CType: 1, Payload: payload}
+}
+
+// InterfaceObject encodes info as an Interface Information Object, including only its non zero fields.
+func InterfaceObject(info InterfaceInfo) Object {
+	ctype := uint8(info.Role) << 6
+	var payload []byte
+	if info.IfIndex != 0 {
+		ctype |= ifInfoIndex
+		payload = binary.BigEndian.AppendUint32(payload, info.IfIndex)
+	}
+	if info.Addr != nil {
+		ctype |= ifInfoAddr
+		if v4 := info.Addr.To4(); v4 != nil {
+			payload = append(payload, 0, afiIPv4, 0, 0)
+			payload = append(payload, v4...)
+		} else {
+			payload = append(payload, 0, afiIPv6, 0, 0)
+			payload = append(payload, info.Addr.To16()...)
+		}
+	}
+	if info.Name != "" {
+		ctype |= ifInfoName
+		name := info.Name
+		if len(name) > 63 {
+			name = name[:63]
+		}
+		size := (1 + len(name) + 3) / 4 * 4
+		sub := make([]byte, size)
+		sub[0] = byte(size)
+		copy(sub[1:], name)
+		payload = append(payload, sub...)
+	}
+	if info.MTU != 0 {
+		ctype |= ifInfoMTU
+		payload = binary.BigEndian.AppendUint32(payload, info.MTU)
+	}
+	return Object{Class: ClassInterfaceInfo, CType: ctype, Payload: payload}
+}
+
+// Marshal encodes objects as an extension structure, to be appended to an original datagram field of at least 128 bytes.
+func Marshal(objects ...Object) []byte {
+	b := []byte{extensionVersion << 4, 0, 0, 0}
+	for _, obj := range objects {
+		b = binary.BigEndian.AppendUint16(b, uint16(4+len(obj.Payload)))
+		b = append(b, obj.Class, obj.CType)
+		b = append(b, obj.Payload...)
+	}
+	binary.BigEndian.PutUint16(b[2:], checksum(b))
+	return b
+}
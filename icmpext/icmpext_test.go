@@ -0,0 +1,98 @@
+package icmpext
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// timeExceeded builds a Time Exceeded message quoting orig, padded to pad bytes, followed by ext.
+func timeExceeded(length byte, orig []byte, pad int, ext []byte) []byte {
+	msg := []byte{11, 0, 0, 0, 0, length, 0, 0}
+	field := make([]byte, pad)
+	copy(field, orig)
+	msg = append(msg, field...)
+	return append(msg, ext...)
+}
+
+func TestParseMessage(t *testing.T) {
+	labels := []MPLSLabel{
+		{Label: 24001, TC: 0, S: false, TTL: 1},
+		{Label: 16, TC: 5, S: true, TTL: 254},
+	}
+	orig := make([]byte, 28)
+	orig[0] = 0x45
+	ext := Marshal(MPLSObject(labels))
+
+	corrupt := append([]byte(nil), ext...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    []MPLSLabel
+		wantErr bool
+	}{
+		{name: "RFC 4884 length", msg: timeExceeded(32, orig, 128, ext), want: labels},
+		{name: "RFC 4884 longer original datagram", msg: timeExceeded(40, orig, 160, ext), want: labels},
+		{name: "non-compliant 128 byte padding", msg: timeExceeded(0, orig, 128, ext), want: labels},
+		{name: "no extensions", msg: timeExceeded(0, orig, 28, nil)},
+		{name: "long original datagram", msg: timeExceeded(0, orig, 200, nil)},
+		{name: "bad checksum", msg: timeExceeded(32, orig, 128, corrupt), wantErr: true},
+		{name: "bad checksum non-compliant", msg: timeExceeded(0, orig, 128, corrupt)},
+		{name: "echo reply", msg: append([]byte{0, 0, 0, 0, 0, 32, 0, 0}, make([]byte, 200)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exts, err := ParseMessage(test.msg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error: %v, want error: %v", err, test.wantErr)
+			}
+			var got []MPLSLabel
+			if exts != nil {
+				got = exts.MPLS
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got: %v, want: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMPLSLabelString(t *testing.T) {
+	l := MPLSLabel{Label: 24001, TC: 3, S: true, TTL: 1}
+	if got := l.String(); got != "Label=24001 TC/EXP=3 S=1 TTL=1" {
+		t.Errorf("got: %s", got)
+	}
+}
+
+func TestInterfaceInfo(t *testing.T) {
+	incoming := InterfaceInfo{Role: RoleIncoming, IfIndex: 523, Addr: net.ParseIP("203.118.6.149").To4(), Name: "ae1.0", MTU: 9000}
+	outgoing := InterfaceInfo{Role: RoleOutgoing, Name: "xe-0/0/1.100"}
+	nextHop := InterfaceInfo{Role: RoleNextHop, Addr: net.ParseIP("2001:db8::1")}
+	labels := []MPLSLabel{{Label: 24001, S: true, TTL: 1}}
+
+	orig := make([]byte, 28)
+	orig[0] = 0x45
+	msg := timeExceeded(32, orig, 128, Marshal(MPLSObject(labels), InterfaceObject(incoming), InterfaceObject(outgoing), InterfaceObject(nextHop)))
+
+	exts, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !reflect.DeepEqual(exts.MPLS, labels) {
+		t.Errorf("got labels: %v, want: %v", exts.MPLS, labels)
+	}
+	want := []InterfaceInfo{incoming, outgoing, nextHop}
+	if !reflect.DeepEqual(exts.Interfaces, want) {
+		t.Errorf("got: %+v, want: %+v", exts.Interfaces, want)
+	}
+	if got := exts.Interfaces[0].String(); got != "incoming interface ae1.0 203.118.6.149 MTU=9000 ifIndex=523" {
+		t.Errorf("got: %s", got)
+	}
+
+	truncated := Object{Class: ClassInterfaceInfo, CType: ifInfoIndex | ifInfoMTU, Payload: []byte{0, 0, 2, 11}}
+	if _, err := ParseMessage(timeExceeded(32, orig, 128, Marshal(truncated))); err == nil {
+		t.Error("expected error for truncated interface information")
+	}
+}
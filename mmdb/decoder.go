@@ -0,0 +1,217 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("invalid MaxMind DB: truncated data section")
+
+// maxDepth is how deep maps and arrays can nest, as in libmaxminddb. It also stops pointers back into a value being decoded.
+const maxDepth = 32
+
+// decoder reads values from a data section, pointers are resolved relative to the start of buf.
+type decoder struct {
+	buf []byte
+	// depth is how many maps and arrays the value being decoded is in
+	depth int
+}
+
+// decode returns the value at offset and the offset just after it, following pointers.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	typ, size, offset, err := d.controlByte(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != typePointer {
+		return d.decodeValueOfType(typ, size, offset)
+	}
+	// size carries the pointer target, which must not be another pointer
+	typ, size, target, err := d.controlByte(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		return nil, 0, errors.New("invalid MaxMind DB: pointer to pointer")
+	}
+	v, _, err := d.decodeValueOfType(typ, size, target)
+	return v, offset, err
+}
+
+/*
+controlByte parses the control byte(s) at offset, returning the type, payload size and the payload offset.
+For pointers the returned size is the pointer target.
+*/
+func (d *decoder) controlByte(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errTruncated
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == typePointer {
+		ss := uint(ctrl>>3) & 0x3
+		vvv := uint(ctrl & 0x7)
+		b, err := d.bytes(offset, ss+1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset += ss + 1
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(b[0])
+		case 1:
+			p = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		return typ, p, offset, nil
+	}
+
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errTruncated
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+		if typ <= typeMap || typ > typeFloat {
+			return 0, 0, 0, fmt.Errorf("invalid MaxMind DB: unknown extended type %d", typ)
+		}
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+	return typ, size, offset, nil
+}
+
+func (d *decoder) decodeValueOfType(typ int, size uint, offset uint) (interface{}, uint, error) {
+	if typ == typeMap || typ == typeArray {
+		if d.depth >= maxDepth {
+			return nil, 0, fmt.Errorf("invalid MaxMind DB: data nested deeper than %d levels", maxDepth)
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid MaxMind DB: map key is not a string")
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid MaxMind DB: double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid MaxMind DB: float of size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeInt32:
+		var v int32
+		for _, c := range b {
+			v = v<<8 | int32(c)
+		}
+		return int64(v), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("invalid MaxMind DB: unknown type %d", typ)
+}
+
+func (d *decoder) bytes(offset uint, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, errTruncated
+	}
+	return d.buf[offset : offset+n], nil
+}
@@ -0,0 +1,186 @@
+/*
+Package mmdb is a pure Go reader for the MaxMind DB file format used by GeoLite2/GeoIP2 databases.
+
+A database is a binary search tree over the bits of an address, followed by a data section holding
+the records the tree points at, and a metadata map at the end of the file.
+See https://maxmind.github.io/MaxMind-DB/ for the specification.
+*/
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparator is the number of zero bytes between the search tree and the data section.
+const dataSectionSeparator = 16
+
+// ErrNotFound is returned by Lookup when the address has no record.
+var ErrNotFound = errors.New("address not found in database")
+
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	Languages    []string
+	BuildEpoch   uint64
+	Description  map[string]string
+}
+
+type Reader struct {
+	Metadata Metadata
+	buf      []byte
+	data     []byte
+	ipv4Node uint
+}
+
+// Open reads the database at path into memory.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses a database held in buf. buf is retained by the Reader.
+func FromBytes(buf []byte) (*Reader, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start == -1 {
+		return nil, errors.New("invalid MaxMind DB: metadata marker not found")
+	}
+	metaStart := start + len(metadataMarker)
+	raw, _, err := (&decoder{buf: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata: not a map")
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.NodeCount = uint(toUint(meta["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(meta["record_size"]))
+	r.Metadata.IPVersion = uint(toUint(meta["ip_version"]))
+	r.Metadata.BuildEpoch = toUint(meta["build_epoch"])
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	if langs, ok := meta["languages"].([]interface{}); ok {
+		for _, l := range langs {
+			if s, ok := l.(string); ok {
+				r.Metadata.Languages = append(r.Metadata.Languages, s)
+			}
+		}
+	}
+	if desc, ok := meta["description"].(map[string]interface{}); ok {
+		r.Metadata.Description = make(map[string]string)
+		for k, v := range desc {
+			r.Metadata.Description[k], _ = v.(string)
+		}
+	}
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	treeSize := r.Metadata.RecordSize * 2 / 8 * r.Metadata.NodeCount
+	if treeSize+dataSectionSeparator > uint(start) {
+		return nil, errors.New("invalid MaxMind DB: search tree exceeds file size")
+	}
+	r.data = buf[treeSize+dataSectionSeparator : start]
+
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Node = node
+	}
+	return r, nil
+}
+
+/*
+Lookup finds the record for ip, returning the decoded record along with the network it was stored under.
+Records decode to map[string]interface{}, []interface{}, string, float64, uint64, int64, bool or []byte.
+*/
+func (r *Reader) Lookup(ip net.IP) (interface{}, *net.IPNet, error) {
+	node, bits, err := r.start(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodeCount := r.Metadata.NodeCount
+	depth := 0
+	for ; depth < len(bits)*8 && node < nodeCount; depth++ {
+		bit := (bits[depth/8] >> (7 - uint(depth%8))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+	if node == nodeCount {
+		return nil, nil, ErrNotFound
+	}
+	if node < nodeCount {
+		return nil, nil, errors.New("invalid MaxMind DB: search tree deeper than address")
+	}
+	offset := node - nodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, nil, errors.New("invalid MaxMind DB: data pointer out of range")
+	}
+	record, _, err := (&decoder{buf: r.data}).decode(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := net.CIDRMask(depth, len(bits)*8)
+	return record, &net.IPNet{IP: bits.Mask(mask), Mask: mask}, nil
+}
+
+func (r *Reader) start(ip net.IP) (uint, net.IP, error) {
+	if v4 := ip.To4(); v4 != nil {
+		if r.Metadata.IPVersion == 6 {
+			return r.ipv4Node, v4, nil
+		}
+		return 0, v4, nil
+	}
+	if ip.To16() == nil {
+		return 0, nil, fmt.Errorf("invalid IP address: %v", ip)
+	}
+	if r.Metadata.IPVersion == 4 {
+		return 0, nil, fmt.Errorf("cannot look up IPv6 address %v in an IPv4 database", ip)
+	}
+	return 0, ip.To16(), nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) readNode(node uint, bit uint) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := r.buf[node*8+bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
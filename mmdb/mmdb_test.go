@@ -0,0 +1,157 @@
+package mmdb
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", s, err)
+	}
+	return network
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	longName := strings.Repeat("x", 300)
+	networks := []struct {
+		cidr   string
+		record map[string]interface{}
+	}{
+		{"1.0.0.0/8", map[string]interface{}{"autonomous_system_number": uint32(13335), "autonomous_system_organization": "CLOUDFLARENET"}},
+		{"1.2.3.0/24", map[string]interface{}{"autonomous_system_number": uint32(64512), "autonomous_system_organization": longName}},
+		{"203.118.0.0/16", map[string]interface{}{
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": "Singapore"}},
+			"location": map[string]interface{}{"latitude": 1.2897, "longitude": 103.8501, "accuracy_radius": uint16(50)},
+			"tags":     []interface{}{"a", true, int32(-7), float32(0.5)},
+		}},
+	}
+
+	tests := []struct {
+		ip         string
+		wantNet    string
+		wantField  string
+		wantValue  interface{}
+		wantNotHit bool
+	}{
+		// 1.2.3.0/24 splits 1.0.0.0/8, so addresses outside it report the split network
+		{ip: "1.200.0.1", wantNet: "1.128.0.0/9", wantField: "autonomous_system_number", wantValue: uint64(13335)},
+		{ip: "1.2.3.4", wantNet: "1.2.3.0/24", wantField: "autonomous_system_organization", wantValue: longName},
+		{ip: "1.2.4.4", wantNet: "1.2.4.0/22", wantField: "autonomous_system_organization", wantValue: "CLOUDFLARENET"},
+		{ip: "203.118.7.77", wantNet: "203.118.0.0/16", wantField: "tags"},
+		{ip: "8.8.8.8", wantNotHit: true},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			w := NewWriter("Test-ASN", ipVersion)
+			w.RecordSize = recordSize
+			for _, n := range networks {
+				if err := w.Insert(mustCIDR(t, n.cidr), n.record); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			var buf bytes.Buffer
+			if _, err := w.WriteTo(&buf); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			r, err := FromBytes(buf.Bytes())
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if r.Metadata.DatabaseType != "Test-ASN" || int(r.Metadata.IPVersion) != ipVersion || int(r.Metadata.RecordSize) != recordSize {
+				t.Fatalf("unexpected metadata: %+v", r.Metadata)
+			}
+
+			for _, test := range tests {
+				record, network, err := r.Lookup(net.ParseIP(test.ip))
+				if test.wantNotHit {
+					if err != ErrNotFound {
+						t.Errorf("v%d/%d %s: got: %v, want: ErrNotFound", ipVersion, recordSize, test.ip, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("v%d/%d %s: lookup failed: %v", ipVersion, recordSize, test.ip, err)
+				}
+				if network.String() != test.wantNet {
+					t.Errorf("v%d/%d %s: got network: %v, want: %s", ipVersion, recordSize, test.ip, network, test.wantNet)
+				}
+				m := record.(map[string]interface{})
+				if test.wantValue != nil && m[test.wantField] != test.wantValue {
+					t.Errorf("v%d/%d %s: got: %v, want: %v", ipVersion, recordSize, test.ip, m[test.wantField], test.wantValue)
+				}
+			}
+
+			record, _, _ := r.Lookup(net.ParseIP("203.118.7.77"))
+			location := record.(map[string]interface{})["location"].(map[string]interface{})
+			if location["latitude"] != 1.2897 || location["accuracy_radius"] != uint64(50) {
+				t.Errorf("v%d/%d: unexpected location: %v", ipVersion, recordSize, location)
+			}
+			tags := record.(map[string]interface{})["tags"].([]interface{})
+			if tags[0] != "a" || tags[1] != true || tags[2] != int64(-7) || tags[3] != 0.5 {
+				t.Errorf("v%d/%d: unexpected tags: %v", ipVersion, recordSize, tags)
+			}
+		}
+	}
+}
+
+func TestDecodePointer(t *testing.T) {
+	// A map at offset 0 whose value is a pointer to the string at offset 7
+	data := []byte{
+		0xe1,                // map, 1 entry
+		0x43, 'k', 'e', 'y', // "key"
+		0x20, 0x07, // pointer to offset 7
+		0x42, 'h', 'i', // "hi"
+	}
+	v, _, err := (&decoder{buf: data}).decode(0)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got := v.(map[string]interface{})["key"]; got != "hi" {
+		t.Errorf("got: %v, want: hi", got)
+	}
+
+	loop := []byte{0x20, 0x00}
+	if _, _, err := (&decoder{buf: loop}).decode(0); err == nil {
+		t.Error("expected error for pointer to pointer")
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	// arrays of one element nested n deep around an empty string
+	nested := func(n int) []byte {
+		var data []byte
+		for i := 0; i < n; i++ {
+			data = append(data, 0x01, typeArray-7)
+		}
+		return append(data, 0x40)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"nested to the limit", nested(maxDepth), true},
+		{"nested too deep", nested(maxDepth + 1), false},
+		// a map whose value points back to the map
+		{"pointer cycle", []byte{0xe1, 0x43, 'k', 'e', 'y', 0x20, 0x00}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := (&decoder{buf: tt.data}).decode(0)
+			if (err == nil) != tt.ok {
+				t.Errorf("got: %v, want ok: %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFromBytesInvalid(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Error("expected error for missing metadata")
+	}
+}
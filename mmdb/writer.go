@@ -0,0 +1,278 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+Writer builds MaxMind DB files. It keeps the whole tree in memory and is meant for
+small databases in tests and simulations rather than for production datasets.
+
+Records may be built from map[string]interface{}, []interface{}, []string, string, []byte, bool,
+float32, float64, uint16, uint32, uint64, int32 and int values.
+*/
+type Writer struct {
+	DatabaseType string
+	Description  map[string]string
+	Languages    []string
+	IPVersion    int
+	// RecordSize is 24, 28 or 32. Zero picks the smallest size that fits.
+	RecordSize int
+	root       *treeNode
+}
+
+type treeNode struct {
+	children [2]*treeNode
+	record   interface{}
+	leaf     bool
+	id       uint
+}
+
+// NewWriter creates a Writer for an IPv4 (ipVersion 4) or IPv6 (ipVersion 6) tree.
+func NewWriter(databaseType string, ipVersion int) *Writer {
+	return &Writer{DatabaseType: databaseType, IPVersion: ipVersion, Languages: []string{"en"}, root: &treeNode{}}
+}
+
+// Insert stores record for network. IPv4 networks in an IPv6 tree are stored under ::/96.
+func (w *Writer) Insert(network *net.IPNet, record interface{}) error {
+	ones, bits := network.Mask.Size()
+	ip := network.IP.To4()
+	if ip == nil || bits != 32 {
+		ip = network.IP.To16()
+		if w.IPVersion == 4 {
+			return fmt.Errorf("cannot insert IPv6 network %v in an IPv4 database", network)
+		}
+	} else if w.IPVersion == 6 {
+		ip = append(make(net.IP, 12), ip...)
+		ones += 96
+	}
+	if ones == 0 {
+		return errors.New("cannot insert a record for the whole address space")
+	}
+
+	node := w.root
+	for depth := 0; depth < ones; depth++ {
+		if node.leaf {
+			// Split a covering network so a more specific one can be stored below it
+			node.children = [2]*treeNode{{record: node.record, leaf: true}, {record: node.record, leaf: true}}
+			node.leaf, node.record = false, nil
+		}
+		bit := (ip[depth/8] >> (7 - uint(depth%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &treeNode{}
+		}
+		node = node.children[bit]
+	}
+	node.children = [2]*treeNode{}
+	node.record, node.leaf = record, true
+	return nil
+}
+
+// WriteTo serializes the database to out.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	// Number the internal nodes breadth first, the root is node 0
+	var nodes []*treeNode
+	queue := []*treeNode{w.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		n.id = uint(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && !c.leaf {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+
+	var data bytes.Buffer
+	offsets := make(map[*treeNode]uint)
+	for _, n := range nodes {
+		for _, c := range n.children {
+			if c != nil && c.leaf {
+				offsets[c] = uint(data.Len())
+				if err := encode(&data, c.record); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	recordSize := w.RecordSize
+	if recordSize == 0 {
+		recordSize = 24
+		if max := nodeCount + dataSectionSeparator + uint(data.Len()); max >= 1<<28 {
+			recordSize = 32
+		} else if max >= 1<<24 {
+			recordSize = 28
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		var records [2]uint
+		for i, c := range n.children {
+			switch {
+			case c == nil:
+				records[i] = nodeCount
+			case c.leaf:
+				records[i] = nodeCount + dataSectionSeparator + offsets[c]
+			default:
+				records[i] = c.id
+			}
+		}
+		writeNode(&buf, recordSize, records[0], records[1])
+	}
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data.Bytes())
+	buf.Write(metadataMarker)
+
+	description := make(map[string]interface{})
+	for k, v := range w.Description {
+		description[k] = v
+	}
+	meta := map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               w.DatabaseType,
+		"description":                 description,
+		"ip_version":                  uint16(w.IPVersion),
+		"languages":                   w.Languages,
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	}
+	if err := encode(&buf, meta); err != nil {
+		return 0, err
+	}
+	n, err := out.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func writeNode(buf *bytes.Buffer, recordSize int, left, right uint) {
+	switch recordSize {
+	case 24:
+		buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	case 28:
+		buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+			byte(left>>20)&0xF0 | byte(right>>24)&0x0F,
+			byte(right >> 16), byte(right >> 8), byte(right)})
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint32(b[:4], uint32(left))
+		binary.BigEndian.PutUint32(b[4:], uint32(right))
+		buf.Write(b[:])
+	}
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		writeControl(buf, typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encode(buf, k)
+			if err := encode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		writeControl(buf, typeArray, len(v))
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+	case []string:
+		writeControl(buf, typeArray, len(v))
+		for _, e := range v {
+			encode(buf, e)
+		}
+	case string:
+		writeControl(buf, typeString, len(v))
+		buf.WriteString(v)
+	case []byte:
+		writeControl(buf, typeBytes, len(v))
+		buf.Write(v)
+	case bool:
+		b := 0
+		if v {
+			b = 1
+		}
+		writeControl(buf, typeBool, b)
+	case float64:
+		writeControl(buf, typeDouble, 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		writeControl(buf, typeFloat, 4)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(v))
+	case uint16:
+		writeUint(buf, typeUint16, uint64(v))
+	case uint32:
+		writeUint(buf, typeUint32, uint64(v))
+	case uint64:
+		writeUint(buf, typeUint64, v)
+	case int:
+		if v >= 0 && v <= math.MaxUint32 {
+			writeUint(buf, typeUint32, uint64(v))
+		} else {
+			return encode(buf, int32(v))
+		}
+	case int32:
+		writeControl(buf, typeInt32, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	default:
+		return fmt.Errorf("unsupported record value type %T", v)
+	}
+	return nil
+}
+
+// writeUint writes v with leading zero bytes stripped, as the format allows.
+func writeUint(buf *bytes.Buffer, typ int, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	trimmed := bytes.TrimLeft(b[:], "\x00")
+	writeControl(buf, typ, len(trimmed))
+	buf.Write(trimmed)
+}
+
+func writeControl(buf *bytes.Buffer, typ int, size int) {
+	var ctrl byte
+	if typ <= typeMap {
+		ctrl = byte(typ) << 5
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		s := size - 285
+		extra = []byte{byte(s >> 8), byte(s)}
+	default:
+		ctrl |= 31
+		s := size - 65821
+		extra = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	buf.WriteByte(ctrl)
+	if typ > typeMap {
+		buf.WriteByte(byte(typ - 7))
+	}
+	buf.Write(extra)
+}
@@ -0,0 +1,73 @@
+package netio
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/ipv4"
+)
+
+// ICMPConn is a raw ICMP socket. The kernel strips the IP header of what it receives, Receive puts it back.
+type ICMPConn struct {
+	conn  *ipv4.PacketConn
+	laddr net.IP
+}
+
+// ListenICMP opens a raw ICMP socket bound to laddr, with opts applied.
+func ListenICMP(laddr net.IP, opts SocketOptions) (*ICMPConn, error) {
+	lc := net.ListenConfig{Control: opts.Control}
+	c, err := lc.ListenPacket(context.Background(), "ip4:icmp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv4.NewPacketConn(c)
+	// ask for the TTL of each reply, it tells how long the way back was
+	if err := conn.SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ICMPConn{conn: conn, laddr: laddr}, nil
+}
+
+func (c *ICMPConn) Send(dst net.IP, ttl int, payload []byte) error {
+	if err := c.conn.SetTTL(ttl); err != nil {
+		return err
+	}
+	_, err := c.conn.WriteTo(payload, nil, &net.IPAddr{IP: dst})
+	return err
+}
+
+func (c *ICMPConn) Receive() (Packet, error) {
+	buf := make([]byte, 1500)
+	n, cm, peer, err := c.conn.ReadFrom(buf)
+	at := time.Now()
+	if err != nil {
+		return Packet{}, err
+	}
+	src, dst, ttl := net.IP(nil), c.laddr, 0
+	if ipAddr, ok := peer.(*net.IPAddr); ok {
+		src = ipAddr.IP
+	}
+	if cm != nil {
+		ttl = cm.TTL
+		if cm.Dst != nil {
+			dst = cm.Dst
+		}
+	}
+	data, err := Datagram(src, dst, layers.IPProtocolICMPv4, ttl, buf[:n])
+	return Packet{Data: data, At: at}, err
+}
+
+func (c *ICMPConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ICMPConn) LocalAddr() net.IP {
+	return c.laddr
+}
+
+func (c *ICMPConn) Close() error {
+	return c.conn.Close()
+}
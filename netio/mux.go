@@ -0,0 +1,168 @@
+package netio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrMuxFull is returned by Mux.Open when every key is taken by an open trace
+var ErrMuxFull = errors.New("no probe IDs left, too many traces running")
+
+/*
+Mux shares one Conn, a raw socket or a capture, between the traces running at the same time. Each trace opens
+its own MuxConn with a key no other open one has and derives the IDs of its probes from it, the ICMP echo ID
+or a block of TCP source ports. demux finds that key back in every datagram received, replies and captured
+probes, and the datagram is handed to the MuxConn holding it. Datagrams without a key, or with nobody holding
+it, are dropped.
+*/
+type Mux struct {
+	conn  Conn
+	keys  int
+	demux func(datagram []byte) (key int, ok bool)
+
+	mu   sync.Mutex
+	open map[int]*MuxConn
+	// keys are handed out in turn, a late reply to a finished trace is unlikely to find its key reused
+	next int
+	// sending is serialized, setting the TTL and writing are separate calls on a socket
+	sendMu sync.Mutex
+}
+
+// NewMux starts reading conn for traces holding keys 0 to keys-1. Closing the Mux closes conn.
+func NewMux(conn Conn, keys int, demux func(datagram []byte) (key int, ok bool)) *Mux {
+	m := &Mux{conn: conn, keys: keys, demux: demux, open: make(map[int]*MuxConn)}
+	go m.read()
+	return m
+}
+
+// read hands what conn receives to the MuxConns until it is closed
+func (m *Mux) read() {
+	for {
+		p, err := m.conn.Receive()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		key, ok := m.demux(p.Data)
+		if !ok {
+			continue
+		}
+		m.mu.Lock()
+		c := m.open[key]
+		m.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		// like a socket buffer, what a slow trace doesn't read in time is lost
+		select {
+		case c.packets <- p:
+		default:
+		}
+	}
+}
+
+// Open returns a connection for a new trace, with a key of its own until it is closed.
+func (m *Mux) Open() (*MuxConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 0; i < m.keys; i++ {
+		key := (m.next + i) % m.keys
+		if m.open[key] != nil {
+			continue
+		}
+		m.next = key + 1
+		c := &MuxConn{Key: key, mux: m, packets: make(chan Packet, 64), closed: make(chan struct{})}
+		m.open[key] = c
+		return c, nil
+	}
+	return nil, ErrMuxFull
+}
+
+// LocalAddr is the source address of every trace on the Mux
+func (m *Mux) LocalAddr() net.IP {
+	return m.conn.LocalAddr()
+}
+
+// Close closes the shared connection, the MuxConns still open stop receiving.
+func (m *Mux) Close() error {
+	return m.conn.Close()
+}
+
+// MuxConn is the view of one trace on a Mux, it only receives the datagrams carrying its key.
+type MuxConn struct {
+	Key int
+
+	mux     *Mux
+	packets chan Packet
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+var _ Conn = (*MuxConn)(nil)
+
+func (c *MuxConn) Send(dst net.IP, ttl int, payload []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	c.mux.sendMu.Lock()
+	defer c.mux.sendMu.Unlock()
+	return c.mux.conn.Send(dst, ttl, payload)
+}
+
+func (c *MuxConn) Receive() (Packet, error) {
+	// checked first, a select on a passed deadline as well could pick either
+	select {
+	case <-c.closed:
+		return Packet{}, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-c.packets:
+		return p, nil
+	case <-expired:
+		return Packet{}, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return Packet{}, net.ErrClosed
+	}
+}
+
+func (c *MuxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MuxConn) LocalAddr() net.IP {
+	return c.mux.conn.LocalAddr()
+}
+
+// Close gives the key back, the shared connection stays open.
+func (c *MuxConn) Close() error {
+	c.once.Do(func() {
+		c.mux.mu.Lock()
+		delete(c.mux.open, c.Key)
+		c.mux.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
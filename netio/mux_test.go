@@ -0,0 +1,82 @@
+package netio
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanConn receives what is put on in, everything sent is dropped
+type chanConn struct {
+	in     chan Packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *chanConn) Send(dst net.IP, ttl int, payload []byte) error { return nil }
+func (c *chanConn) SetReadDeadline(t time.Time) error              { return nil }
+func (c *chanConn) LocalAddr() net.IP                              { return net.IPv4(192, 168, 1, 10) }
+
+func (c *chanConn) Receive() (Packet, error) {
+	select {
+	case p := <-c.in:
+		return p, nil
+	case <-c.closed:
+		return Packet{}, net.ErrClosed
+	}
+}
+
+func (c *chanConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestMux(t *testing.T) {
+	conn := &chanConn{in: make(chan Packet), closed: make(chan struct{})}
+	// the key is the first byte of the datagram
+	mux := NewMux(conn, 2, func(datagram []byte) (int, bool) { return int(datagram[0]), len(datagram) > 0 })
+	defer mux.Close()
+
+	a, err := mux.Open()
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	b, err := mux.Open()
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if a.Key == b.Key {
+		t.Fatalf("both traces got key %d", a.Key)
+	}
+	if _, err := mux.Open(); err != ErrMuxFull {
+		t.Errorf("got: %v, want: %v", err, ErrMuxFull)
+	}
+
+	// unknown keys are dropped, the others go to their trace only
+	conn.in <- Packet{Data: []byte{7}}
+	conn.in <- Packet{Data: []byte{byte(b.Key), 'b'}}
+	conn.in <- Packet{Data: []byte{byte(a.Key), 'a'}}
+	for _, c := range []*MuxConn{a, b} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		p, err := c.Receive()
+		if err != nil || p.Data[0] != byte(c.Key) {
+			t.Errorf("key %d: got: %v %v, want its own datagram", c.Key, p.Data, err)
+		}
+		c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if p, err := c.Receive(); err != os.ErrDeadlineExceeded {
+			t.Errorf("key %d: got: %v %v, want: %v", c.Key, p.Data, err, os.ErrDeadlineExceeded)
+		}
+	}
+
+	// closing gives the key back
+	a.Close()
+	if _, err := a.Receive(); err != net.ErrClosed {
+		t.Errorf("got: %v, want: %v", err, net.ErrClosed)
+	}
+	c, err := mux.Open()
+	if err != nil || c.Key != a.Key {
+		t.Errorf("got: key %v %v, want: key %d", c, err, a.Key)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Package netio is the packet I/O the probers sit on: send a probe with a TTL, receive IP datagrams with
+the time they arrived. The raw sockets and pcap handles used for real traces implement Conn, and so does
+the simulated network of package netsim, which lets the probers be tested without root or a network.
+*/
+package netio
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Packet is an IPv4 datagram, header included, and when it was sent or received.
+type Packet struct {
+	Data []byte
+	At   time.Time
+}
+
+// Conn sends the probes of one protocol and receives what comes back.
+type Conn interface {
+	// Send transmits payload, an ICMP message or TCP segment, to dst with the given TTL. The IP header is added below.
+	Send(dst net.IP, ttl int, payload []byte) error
+	// Receive blocks until a datagram arrives or the read deadline passes.
+	// Connections built on a capture also return the probes they sent.
+	Receive() (Packet, error)
+	// SetReadDeadline sets when Receive gives up, the zero time means never.
+	SetReadDeadline(t time.Time) error
+	// LocalAddr is the source address of the probes.
+	LocalAddr() net.IP
+	Close() error
+}
+
+// Datagram builds the IPv4 datagram carrying payload, for when only the payload was seen on a socket.
+func Datagram(src, dst net.IP, proto layers.IPProtocol, ttl int, payload []byte) ([]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      uint8(ttl),
+		Protocol: proto,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SetTOS sets the TOS byte of datagram, the DSCP and ECN bits, and updates the header checksum.
+func SetTOS(datagram []byte, tos uint8) {
+	if len(datagram) < 20 {
+		return
+	}
+	datagram[1] = tos
+	header := datagram[:int(datagram[0]&0x0f)*4]
+	binary.BigEndian.PutUint16(header[10:], 0)
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(header[10:], ^uint16(sum))
+}
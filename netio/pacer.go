@@ -0,0 +1,41 @@
+package netio
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Pacer spaces out packets to cap their rate. Traces running concurrently share one to keep under a global
+packets per second budget, each Wait takes the next free slot whichever trace asks for it.
+*/
+type Pacer struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewPacer returns a Pacer letting pps packets per second through, nil (no limit) if pps is not positive.
+func NewPacer(pps int) *Pacer {
+	if pps <= 0 {
+		return nil
+	}
+	return &Pacer{interval: time.Second / time.Duration(pps)}
+}
+
+// Wait blocks until the next packet may be sent. A nil Pacer never blocks.
+func (p *Pacer) Wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
@@ -0,0 +1,32 @@
+package netio
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	if NewPacer(0) != nil {
+		t.Error("expected no pacer without a rate")
+	}
+	var nilPacer *Pacer
+	nilPacer.Wait()
+
+	// 10 packets at 100 pps from 5 senders, the first one goes right away
+	p := NewPacer(100)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Wait()
+			p.Wait()
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("got: %v, want: at least 90ms", elapsed)
+	}
+}
@@ -0,0 +1,26 @@
+package netio
+
+import "syscall"
+
+// SocketOptions tie the probe sockets to a routing domain, for hosts using VRFs or policy routing.
+type SocketOptions struct {
+	// BindDevice is the device or VRF the sockets are bound to (SO_BINDTODEVICE), probes leave through it
+	// and only what arrives on it is received
+	BindDevice string
+	// Mark is the firewall mark set on the probes (SO_MARK), for policy routing rules to match, 0 for none
+	Mark int
+	// TOS is the DSCP and ECN byte of the probes (IP_TOS), 0 leaves them unmarked
+	TOS uint8
+}
+
+// Control applies the options to a socket before it is bound or connected, it fits net.ListenConfig and net.Dialer.
+func (o SocketOptions) Control(network, address string, c syscall.RawConn) error {
+	if o.BindDevice == "" && o.Mark == 0 && o.TOS == 0 {
+		return nil
+	}
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) { err = o.apply(int(fd)) }); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
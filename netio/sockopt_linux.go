@@ -0,0 +1,20 @@
+package netio
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func (o SocketOptions) apply(fd int) error {
+	if o.BindDevice != "" {
+		if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.BindDevice); err != nil {
+			return fmt.Errorf("failed to bind to device %s: %v", o.BindDevice, err)
+		}
+	}
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+			return fmt.Errorf("failed to set fwmark %d: %v", o.Mark, err)
+		}
+	}
+	return setTOS(fd, o.TOS)
+}
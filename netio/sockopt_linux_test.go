@@ -0,0 +1,46 @@
+package netio
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("fwmarks need CAP_NET_ADMIN")
+	}
+	opts := SocketOptions{BindDevice: "lo", Mark: 42, TOS: 0xb8}
+	lc := net.ListenConfig{Control: opts.Control}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get raw conn: %v", err)
+	}
+	var mark, tos int
+	var device string
+	raw.Control(func(fd uintptr) {
+		mark, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+		tos, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		device, _ = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	if mark != 42 || device != "lo" || tos != 0xb8 {
+		t.Errorf("got: mark %d device %q tos %#x, want: mark 42 device %q tos 0xb8", mark, device, tos, "lo")
+	}
+}
+
+func TestSocketOptionsUnknownDevice(t *testing.T) {
+	lc := net.ListenConfig{Control: SocketOptions{BindDevice: "no-such-dev0"}.Control}
+	if conn, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0"); err == nil {
+		conn.Close()
+		t.Error("expected error for unknown device")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package netio
+
+import "errors"
+
+func (o SocketOptions) apply(fd int) error {
+	if o.BindDevice != "" || o.Mark != 0 {
+		return errors.New("binding to a device and fwmarks are only supported on Linux")
+	}
+	return setTOS(fd, o.TOS)
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package netio
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setTOS(fd int, tos uint8) error {
+	if tos == 0 {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, int(tos)); err != nil {
+		return fmt.Errorf("failed to set TOS %#x: %v", tos, err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package netio
+
+import "errors"
+
+func setTOS(fd int, tos uint8) error {
+	if tos == 0 {
+		return nil
+	}
+	return errors.New("setting the TOS of the probes is not supported on this platform")
+}
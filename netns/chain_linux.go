@@ -0,0 +1,182 @@
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrNetem is returned by Build when a link asks for delay or loss and the kernel has no netem qdisc
+var ErrNetem = errors.New("netem qdisc not available")
+
+// Device is the name of the prober's interface, the one to capture on
+const Device = "veth-next"
+
+// Link is the link from a node back towards the prober. netem adds its delay and loss to what the node sends that way.
+type Link struct {
+	Delay time.Duration
+	// Loss is the probability that a packet is dropped, between 0 and 1
+	Loss float64
+}
+
+// Topology is a chain of routers between the prober and the target.
+type Topology struct {
+	Routers []Link
+	Target  Link
+}
+
+/*
+Chain is a built topology. Every node is a network namespace, joined to its neighbours by veth pairs on the
+subnets 10.99.<n>.0/30, n counting the links from the prober. The node on the prober side of a link has .1,
+the other one .2, so router n answers from 10.99.n.2.
+*/
+type Chain struct {
+	// Prober and TargetNS are the paths of the namespaces at both ends
+	Prober   string
+	TargetNS string
+	// Source is the prober's address
+	Source net.IP
+	// Routers are the addresses the routers answer from, in order
+	Routers []net.IP
+	Target  net.IP
+
+	names []string
+}
+
+// Build creates the namespaces of topology. Close removes them.
+func Build(topology Topology) (*Chain, error) {
+	c := &Chain{}
+	nodes := len(topology.Routers) + 2
+	for i := 0; i < nodes; i++ {
+		name := fmt.Sprintf("trt-%d-%d", os.Getpid(), i)
+		if err := run("ip", "netns", "add", name); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.names = append(c.names, name)
+	}
+	c.Prober = nsPath(c.names[0])
+	c.TargetNS = nsPath(c.names[nodes-1])
+	if err := c.setup(topology); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Chain) setup(topology Topology) error {
+	links := append(append([]Link(nil), topology.Routers...), topology.Target)
+	for n := 1; n < len(c.names); n++ {
+		prev, next := c.names[n-1], c.names[n]
+		cmds := [][]string{
+			{"ip", "link", "add", "veth-next", "netns", prev, "type", "veth", "peer", "name", "veth-prev", "netns", next},
+			{"ip", "-n", prev, "addr", "add", addr(n, 1) + "/30", "dev", "veth-next"},
+			{"ip", "-n", next, "addr", "add", addr(n, 2) + "/30", "dev", "veth-prev"},
+			{"ip", "-n", prev, "link", "set", "dev", "veth-next", "up"},
+			{"ip", "-n", next, "link", "set", "dev", "veth-prev", "up"},
+		}
+		for _, cmd := range cmds {
+			if err := run(cmd[0], cmd[1:]...); err != nil {
+				return err
+			}
+		}
+		if err := netem(next, links[n-1]); err != nil {
+			return err
+		}
+	}
+
+	last := len(c.names) - 1
+	for n, name := range c.names {
+		if err := run("ip", "-n", name, "link", "set", "dev", "lo", "up"); err != nil {
+			return err
+		}
+		// everything is sent towards the target, except replies to the subnets behind
+		if n < last {
+			if err := run("ip", "-n", name, "route", "add", "default", "via", addr(n+1, 2)); err != nil {
+				return err
+			}
+		}
+		for k := 1; k < n; k++ {
+			if err := run("ip", "-n", name, "route", "add", fmt.Sprintf("10.99.%d.0/30", k), "via", addr(n, 1)); err != nil {
+				return err
+			}
+		}
+		if n == last {
+			if err := run("ip", "-n", name, "route", "add", "default", "via", addr(n, 1)); err != nil {
+				return err
+			}
+		}
+		if n > 0 && n < last {
+			c.Routers = append(c.Routers, net.ParseIP(addr(n, 2)).To4())
+			if err := Do(nsPath(name), enableForwarding); err != nil {
+				return err
+			}
+		}
+	}
+	c.Source = net.ParseIP(addr(1, 1)).To4()
+	c.Target = net.ParseIP(addr(last, 2)).To4()
+	return nil
+}
+
+// InProber runs fn in the prober's namespace
+func (c *Chain) InProber(fn func() error) error {
+	return Do(c.Prober, fn)
+}
+
+// InTarget runs fn in the target's namespace, e.g. to start a listener there
+func (c *Chain) InTarget(fn func() error) error {
+	return Do(c.TargetNS, fn)
+}
+
+// Close deletes the namespaces, and with them the veth pairs
+func (c *Chain) Close() error {
+	var err error
+	for _, name := range c.names {
+		if e := run("ip", "netns", "del", name); e != nil && err == nil {
+			err = e
+		}
+	}
+	c.names = nil
+	return err
+}
+
+// netem adds the delay and loss of link to the node's interface towards the prober
+func netem(name string, link Link) error {
+	if link.Delay == 0 && link.Loss == 0 {
+		return nil
+	}
+	args := []string{"-n", name, "qdisc", "add", "dev", "veth-prev", "root", "netem"}
+	if link.Delay > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", link.Delay.Microseconds()))
+	}
+	if link.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", link.Loss*100))
+	}
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil && strings.Contains(string(out), "qdisc kind is unknown") {
+		return fmt.Errorf("%w: %s", ErrNetem, strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func enableForwarding() error {
+	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run %s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func addr(link, host int) string {
+	return fmt.Sprintf("10.99.%d.%d", link, host)
+}
@@ -0,0 +1,34 @@
+/*
+Package netns runs code inside Linux network namespaces and builds the namespace topologies the
+integration tests trace through.
+*/
+package netns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Path returns the file of the network namespace spec names: a name created with `ip netns add`, a path to a
+namespace file, or the PID of a process inside it, e.g. a container's.
+*/
+func Path(spec string) (string, error) {
+	path := nsPath(spec)
+	if strings.ContainsRune(spec, '/') {
+		path = spec
+	} else if pid, err := strconv.Atoi(spec); err == nil && pid > 0 {
+		path = fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("network namespace %s not found: %v", spec, err)
+	}
+	return path, nil
+}
+
+func nsPath(name string) string {
+	return filepath.Join("/var/run/netns", name)
+}
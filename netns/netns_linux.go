@@ -0,0 +1,46 @@
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Do runs fn with the calling goroutine inside the network namespace at path, e.g. /var/run/netns/<name>.
+Namespaces belong to OS threads, so the goroutine is locked to its thread until the original namespace is
+restored. Sockets opened by fn stay in the namespace after Do returns.
+*/
+func Do(path string, fn func() error) error {
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %v", err)
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer orig.Close()
+	if err := setns(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %v", path, err)
+	}
+	defer func() {
+		// a thread that can't go back stays locked, it exits with the goroutine instead of being reused
+		if setns(orig) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
+
+func setns(f *os.File) error {
+	return unix.Setns(int(f.Fd()), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,48 @@
+package netns
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+	name := "trt-do-test"
+	if err := run("ip", "netns", "add", name); err != nil {
+		t.Fatalf("failed to add namespace: %v", err)
+	}
+	defer run("ip", "netns", "del", name)
+	path, err := Path(name)
+	if err != nil {
+		t.Fatalf("failed to find namespace: %v", err)
+	}
+
+	// a fresh namespace has nothing but loopback
+	var inside []net.Interface
+	err = Do(path, func() (err error) {
+		inside, err = net.Interfaces()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to run in namespace: %v", err)
+	}
+	if len(inside) != 1 || inside[0].Flags&net.FlagLoopback == 0 {
+		t.Errorf("got interfaces %v, want only loopback", inside)
+	}
+
+	// and the goroutine is back where it started
+	outside, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %v", err)
+	}
+	if len(outside) == len(inside) {
+		t.Skip("test host has only loopback, can't tell the namespaces apart")
+	}
+}
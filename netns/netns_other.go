@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netns
+
+import "errors"
+
+// Do is only implemented on Linux.
+func Do(path string, fn func() error) error {
+	return errors.New("network namespaces are only supported on Linux")
+}
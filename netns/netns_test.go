@@ -0,0 +1,32 @@
+package netns
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	if _, err := os.Stat("/proc/self/ns/net"); err != nil {
+		t.Skip("no network namespace files")
+	}
+	tests := []struct {
+		name string
+		spec string
+		want string
+	}{
+		{"path", "/proc/self/ns/net", "/proc/self/ns/net"},
+		{"pid", fmt.Sprint(os.Getpid()), fmt.Sprintf("/proc/%d/ns/net", os.Getpid())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Path(tt.spec)
+			if err != nil || got != tt.want {
+				t.Errorf("got: %v %v, want: %v", got, err, tt.want)
+			}
+		})
+	}
+	if _, err := Path("no-such-namespace"); err == nil {
+		t.Error("expected error for unknown namespace")
+	}
+}
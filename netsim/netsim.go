@@ -0,0 +1,385 @@
+/*
+Package netsim simulates the network between the prober and a target, so the probers can be tested
+deterministically without root or a network.
+
+A Network is a chain of routers followed by the target host. A probe sent with TTL n expires at the
+n-th router, which answers with an ICMP Time Exceeded quoting it; a probe outliving the chain reaches the
+target, which answers Echo Requests with Echo Replies and SYNs with a SYN-ACK or RST. Routers can add
+latency, lose replies, rate limit them, stay silent, balance flows over ECMP siblings and report MPLS
+label stacks in RFC 4950 extensions.
+*/
+package netsim
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/monmohan/traceroute/icmpext"
+	"github.com/monmohan/traceroute/netio"
+)
+
+// Initial TTLs of the replies, routers use 255 like most network operating systems
+const (
+	routerTTL = 255
+	hostTTL   = 64
+)
+
+// quoteLen is how much of the probe the routers quote, the RFC 4884 original datagram field length
+const quoteLen = 128
+
+// Router is one position on the path.
+type Router struct {
+	Addr net.IP
+	// ECMP are further routers sharing the position, each flow is hashed to one of Addr and ECMP
+	ECMP []net.IP
+	// Latency is the round trip time from the prober to the router
+	Latency time.Duration
+	// Loss is the probability that a probe expiring here gets no reply
+	Loss float64
+	// RateLimit is how many ICMP errors the router sends per second, 0 for no limit
+	RateLimit int
+	// Silent routers forward probes but never answer those that expire on them
+	Silent bool
+	// MPLS is the label stack the router reports in its Time Exceeded messages
+	MPLS []icmpext.MPLSLabel
+	// Remark, when set, is the TOS the router rewrites on the probes it forwards, like a QoS policy bleaching DSCP
+	Remark *uint8
+}
+
+// Host is the target at the end of the path.
+type Host struct {
+	Addr    net.IP
+	Latency time.Duration
+	// OpenPorts answer SYNs with a SYN-ACK, other ports with a RST
+	OpenPorts []int
+}
+
+// Network is the path from Local to Target. Replies go back to the source of the probe, Local for its connections.
+type Network struct {
+	Local   net.IP
+	Routers []Router
+	Target  Host
+	// Seed makes losses reproducible
+	Seed int64
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	sent map[string][]time.Time
+}
+
+// Conn returns a connection for probes of proto that only receives replies, like a raw socket.
+func (n *Network) Conn(proto layers.IPProtocol) *Conn {
+	return n.newConn(proto, false)
+}
+
+// CaptureConn returns a connection for probes of proto that also receives the probes it sends, like a capture.
+func (n *Network) CaptureConn(proto layers.IPProtocol) *Conn {
+	return n.newConn(proto, true)
+}
+
+func (n *Network) newConn(proto layers.IPProtocol, capture bool) *Conn {
+	return &Conn{network: n, proto: proto, capture: capture, wake: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+/*
+Respond returns the reply to datagram sent at the given time, and when it arrives back at the prober.
+ok is false when nothing answers. Responders are only looked up for the target, other destinations are not routed.
+*/
+func (n *Network) Respond(datagram []byte, at time.Time) (reply []byte, arrival time.Time, ok bool) {
+	packet := gopacket.NewPacket(datagram, layers.LayerTypeIPv4, gopacket.Default)
+	ip, isIP := packet.NetworkLayer().(*layers.IPv4)
+	if !isIP || !ip.DstIP.Equal(n.Target.Addr) {
+		return nil, time.Time{}, false
+	}
+	ttl := int(ip.TTL)
+	if ttl <= len(n.Routers) {
+		return n.timeExceeded(ttl, ip.SrcIP, datagram, at)
+	}
+
+	hops := len(n.Routers) + 1
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		if !l.SYN || l.ACK {
+			return nil, time.Time{}, false
+		}
+		tcp := &layers.TCP{SrcPort: l.DstPort, DstPort: l.SrcPort, Ack: l.Seq + 1, ACK: true, Window: 65535}
+		tcp.SYN = n.Target.open(int(l.DstPort))
+		tcp.RST = !tcp.SYN
+		if tcp.SYN {
+			tcp.Seq = n.random()
+		}
+		reply, err := n.datagram(n.Target.Addr, ip.SrcIP, hostTTL-hops+1, layers.IPProtocolTCP, tcp)
+		return reply, at.Add(n.Target.Latency), err == nil
+	}
+	if icmp, isICMP := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); isICMP && icmp.TypeCode.Type() == layers.ICMPv4TypeEchoRequest {
+		echo := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: icmp.Id, Seq: icmp.Seq}
+		reply, err := n.datagram(n.Target.Addr, ip.SrcIP, hostTTL-hops+1, layers.IPProtocolICMPv4, echo, gopacket.Payload(icmp.Payload))
+		return reply, at.Add(n.Target.Latency), err == nil
+	}
+	return nil, time.Time{}, false
+}
+
+// timeExceeded is the reply of the router at position ttl, quoting the probe as it arrived there.
+func (n *Network) timeExceeded(ttl int, prober net.IP, datagram []byte, at time.Time) ([]byte, time.Time, bool) {
+	r := n.Routers[ttl-1]
+	addr := r.pick(ttl, datagram)
+	if r.Silent || !n.allow(addr, r, at) {
+		return nil, time.Time{}, false
+	}
+
+	// the probe arrived with TTL 1 and the TOS of the last remark on the way, which changes the header checksum too
+	quoted := append([]byte(nil), datagram...)
+	quoted[8] = 1
+	for _, before := range n.Routers[:ttl-1] {
+		if before.Remark != nil {
+			quoted[1] = *before.Remark
+		}
+	}
+	binary.BigEndian.PutUint16(quoted[10:], 0)
+	binary.BigEndian.PutUint16(quoted[10:], checksum(quoted[:int(quoted[0]&0x0f)*4]))
+	if len(quoted) > quoteLen {
+		quoted = quoted[:quoteLen]
+	}
+
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}
+	body := quoted
+	if len(r.MPLS) > 0 {
+		// RFC 4884: pad the quote to its announced length and append the extension structure
+		body = append(make([]byte, quoteLen), icmpext.Marshal(icmpext.MPLSObject(r.MPLS))...)
+		copy(body, quoted)
+		// the length in 32 bit words sits in the second byte of the otherwise unused field
+		icmp.Id = quoteLen / 4
+	}
+	reply, err := n.datagram(addr, prober, routerTTL-ttl+1, layers.IPProtocolICMPv4, icmp, gopacket.Payload(body))
+	return reply, at.Add(r.Latency), err == nil
+}
+
+// allow decides whether the router replies, applying its loss and rate limit.
+func (n *Network) allow(addr net.IP, r Router, at time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.init()
+	if r.Loss > 0 && n.rng.Float64() < r.Loss {
+		return false
+	}
+	if r.RateLimit <= 0 {
+		return true
+	}
+	key := addr.String()
+	var recent []time.Time
+	for _, t := range n.sent[key] {
+		if at.Sub(t) < time.Second {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= r.RateLimit {
+		n.sent[key] = recent
+		return false
+	}
+	n.sent[key] = append(recent, at)
+	return true
+}
+
+func (n *Network) random() uint32 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.init()
+	return n.rng.Uint32()
+}
+
+// init sets up the random source and rate limit state on first use, n.mu must be held
+func (n *Network) init() {
+	if n.rng == nil {
+		n.rng = rand.New(rand.NewSource(n.Seed))
+		n.sent = make(map[string][]time.Time)
+	}
+}
+
+func (n *Network) datagram(src, dst net.IP, ttl int, proto layers.IPProtocol, l ...gopacket.SerializableLayer) ([]byte, error) {
+	ip := &layers.IPv4{Version: 4, TTL: uint8(ttl), Protocol: proto, SrcIP: src, DstIP: dst}
+	if tcp, ok := l[0].(*layers.TCP); ok {
+		tcp.SetNetworkLayerForChecksum(ip)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{ip}, l...)...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+pick hashes the flow of the probe to one of the routers at this position. Like many routers it hashes
+the ports of TCP and UDP, and for ICMP the whole header, which changes with every Echo Request.
+*/
+func (r Router) pick(position int, datagram []byte) net.IP {
+	if len(r.ECMP) == 0 {
+		return r.Addr
+	}
+	ihl := int(datagram[0]&0x0f) * 4
+	h := fnv.New32a()
+	h.Write([]byte{byte(position), datagram[9]})
+	h.Write(datagram[16:20])
+	if transport := datagram[ihl:]; datagram[9] == byte(layers.IPProtocolICMPv4) && len(transport) >= 8 {
+		h.Write(transport[:8])
+	} else if len(transport) >= 4 {
+		h.Write(transport[:4])
+	}
+	choices := append([]net.IP{r.Addr}, r.ECMP...)
+	return choices[h.Sum32()%uint32(len(choices))]
+}
+
+func (h Host) open(port int) bool {
+	for _, p := range h.OpenPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Conn is a netio.Conn on the simulated network. Replies are delivered in real time, once their latency has passed.
+type Conn struct {
+	// TOS marks what the connection sends, like the IP_TOS socket option
+	TOS uint8
+	// IPID is the IP ID of what the connection sends, the one the kernel would pick for a raw socket
+	IPID uint16
+
+	network *Network
+	proto   layers.IPProtocol
+	capture bool
+
+	mu       sync.Mutex
+	queue    []netio.Packet
+	deadline time.Time
+	wake     chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var _ netio.Conn = (*Conn)(nil)
+
+func (c *Conn) Send(dst net.IP, ttl int, payload []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	datagram, err := netio.Datagram(c.network.Local, dst, c.proto, ttl, payload)
+	if err != nil {
+		return err
+	}
+	if c.IPID != 0 {
+		binary.BigEndian.PutUint16(datagram[4:], c.IPID)
+		binary.BigEndian.PutUint16(datagram[10:], 0)
+		binary.BigEndian.PutUint16(datagram[10:], checksum(datagram[:20]))
+	}
+	if c.TOS != 0 {
+		netio.SetTOS(datagram, c.TOS)
+	}
+	now := time.Now()
+	if c.capture {
+		c.enqueue(netio.Packet{Data: datagram, At: now})
+	}
+	if reply, arrival, ok := c.network.Respond(datagram, now); ok {
+		c.enqueue(netio.Packet{Data: reply, At: arrival})
+	}
+	return nil
+}
+
+func (c *Conn) enqueue(p netio.Packet) {
+	c.mu.Lock()
+	c.queue = append(c.queue, p)
+	sort.SliceStable(c.queue, func(i, j int) bool { return c.queue[i].At.Before(c.queue[j].At) })
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) Receive() (netio.Packet, error) {
+	for {
+		select {
+		case <-c.closed:
+			return netio.Packet{}, net.ErrClosed
+		default:
+		}
+		c.mu.Lock()
+		now := time.Now()
+		deadline := c.deadline
+		var next time.Time
+		if len(c.queue) > 0 {
+			if p := c.queue[0]; !p.At.After(now) {
+				c.queue = c.queue[1:]
+				c.mu.Unlock()
+				return p, nil
+			}
+			next = c.queue[0].At
+		}
+		c.mu.Unlock()
+
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return netio.Packet{}, os.ErrDeadlineExceeded
+		}
+		// sleep until the next packet is due, the deadline passes or something new is sent
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = next.Sub(now)
+		}
+		if !deadline.IsZero() && deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.wake:
+			timer.Stop()
+		case <-c.closed:
+			timer.Stop()
+			return netio.Packet{}, net.ErrClosed
+		}
+	}
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.IP {
+	return c.network.Local
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
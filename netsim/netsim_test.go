@@ -0,0 +1,179 @@
+package netsim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/monmohan/traceroute/icmpext"
+	"github.com/monmohan/traceroute/netio"
+)
+
+var (
+	local  = net.IPv4(192, 168, 1, 10).To4()
+	target = net.IPv4(93, 184, 216, 34).To4()
+)
+
+func network() *Network {
+	return &Network{
+		Local: local,
+		Routers: []Router{
+			{Addr: net.IPv4(192, 168, 1, 1), Latency: time.Millisecond},
+			{Addr: net.IPv4(10, 0, 0, 1), Latency: 2 * time.Millisecond, MPLS: []icmpext.MPLSLabel{{Label: 24001, S: true, TTL: 1}}},
+		},
+		Target: Host{Addr: target, Latency: 3 * time.Millisecond, OpenPorts: []int{443}},
+	}
+}
+
+func echo(t *testing.T, ttl int) []byte {
+	msg := serialize(t, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 7, Seq: uint16(ttl)})
+	d, _ := netio.Datagram(local, target, layers.IPProtocolICMPv4, ttl, msg)
+	return d
+}
+
+func syn(t *testing.T, ttl int, port layers.TCPPort) []byte {
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: port, Seq: 99, SYN: true}
+	tcp.SetNetworkLayerForChecksum(&layers.IPv4{SrcIP: local, DstIP: target, Protocol: layers.IPProtocolTCP})
+	d, _ := netio.Datagram(local, target, layers.IPProtocolTCP, ttl, serialize(t, tcp))
+	return d
+}
+
+func serialize(t *testing.T, l gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, l); err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRespond(t *testing.T) {
+	n := network()
+	now := time.Now()
+
+	reply, arrival, ok := n.Respond(echo(t, 1), now)
+	if !ok || arrival.Sub(now) != time.Millisecond {
+		t.Fatalf("no Time Exceeded from the first router")
+	}
+	packet := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default)
+	ip := packet.NetworkLayer().(*layers.IPv4)
+	icmp := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ip.SrcIP.Equal(n.Routers[0].Addr) || ip.TTL != 255 || icmp.TypeCode.Type() != layers.ICMPv4TypeTimeExceeded {
+		t.Errorf("unexpected reply: %v", packet)
+	}
+	if quoted := icmp.Payload; len(quoted) < 28 || quoted[8] != 1 {
+		t.Errorf("probe not quoted as it arrived: %x", quoted)
+	}
+
+	reply, _, _ = n.Respond(echo(t, 2), now)
+	exts, err := icmpext.ParseMessage(reply[20:])
+	if err != nil || exts == nil || len(exts.MPLS) != 1 || exts.MPLS[0].Label != 24001 {
+		t.Errorf("got extensions: %+v, %v, want the MPLS label stack", exts, err)
+	}
+
+	reply, arrival, _ = n.Respond(echo(t, 3), now)
+	packet = gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default)
+	icmp = packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmp.Seq != 3 || arrival.Sub(now) != 3*time.Millisecond {
+		t.Errorf("got: %v, want Echo Reply", icmp.TypeCode)
+	}
+	if ttl := packet.NetworkLayer().(*layers.IPv4).TTL; ttl != 62 {
+		t.Errorf("got reply TTL: %d, want: 62", ttl)
+	}
+
+	for port, want := range map[layers.TCPPort]string{443: "SYN-ACK", 22: "RST"} {
+		reply, _, ok := n.Respond(syn(t, 10, port), now)
+		if !ok {
+			t.Fatalf("port %d: no reply", port)
+		}
+		tcp := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+		got := "RST"
+		if tcp.SYN && tcp.ACK {
+			got = "SYN-ACK"
+		}
+		if got != want || tcp.Ack != 100 || tcp.DstPort != 40000 {
+			t.Errorf("port %d: got: %s ack %d, want: %s ack 100", port, got, tcp.Ack, want)
+		}
+	}
+}
+
+func TestRouterBehaviour(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		router Router
+		probes int
+		want   int
+	}{
+		{name: "answers", router: Router{}, probes: 3, want: 3},
+		{name: "silent", router: Router{Silent: true}, probes: 3, want: 0},
+		{name: "lossy", router: Router{Loss: 1}, probes: 3, want: 0},
+		{name: "rate limited", router: Router{RateLimit: 2}, probes: 5, want: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := network()
+			test.router.Addr = n.Routers[0].Addr
+			n.Routers[0] = test.router
+			got := 0
+			for i := 0; i < test.probes; i++ {
+				if _, _, ok := n.Respond(echo(t, 1), now); ok {
+					got++
+				}
+			}
+			if got != test.want {
+				t.Errorf("got %d replies, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestECMP(t *testing.T) {
+	n := network()
+	n.Routers[0].ECMP = []net.IP{net.IPv4(192, 168, 1, 2), net.IPv4(192, 168, 1, 3)}
+	seen := make(map[string]bool)
+	for port := layers.TCPPort(1); port < 50; port++ {
+		reply, _, _ := n.Respond(syn(t, 1, port), time.Now())
+		seen[net.IP(reply[12:16]).String()] = true
+		// the same flow always takes the same path
+		again, _, _ := n.Respond(syn(t, 1, port), time.Now())
+		if string(again[12:16]) != string(reply[12:16]) {
+			t.Fatalf("port %d: flow changed path", port)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("got responders: %v, want all three", seen)
+	}
+}
+
+func TestConnDelivery(t *testing.T) {
+	n := network()
+	conn := n.CaptureConn(layers.IPProtocolICMPv4)
+	defer conn.Close()
+
+	sent := time.Now()
+	if err := conn.Send(target, 1, echo(t, 1)[20:]); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	own, err := conn.Receive()
+	if err != nil || own.Data[8] != 1 {
+		t.Fatalf("capture did not see the probe leave: %v", err)
+	}
+	reply, err := conn.Receive()
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if time.Since(sent) < time.Millisecond || reply.At.Sub(own.At) != time.Millisecond {
+		t.Errorf("reply delivered early or with the wrong timestamp")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := conn.Receive(); err == nil {
+		t.Error("expected deadline error")
+	}
+	conn.Close()
+	if _, err := conn.Receive(); err != net.ErrClosed {
+		t.Errorf("got: %v, want: %v", err, net.ErrClosed)
+	}
+}
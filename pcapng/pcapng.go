@@ -0,0 +1,130 @@
+/*
+Package pcapng writes the probes and replies of a trace to a pcapng file.
+
+gopacket's pcapgo writer can't attach comments to packets, here every packet carries one saying which
+TTL and probe it belongs to, so the capture can be read on its own in Wireshark (pkt_comment) or replayed.
+Packets are raw IPv4 datagrams (LINKTYPE_RAW) with nanosecond timestamps.
+*/
+package pcapng
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Block types
+const (
+	blockSectionHeader        = 0x0a0d0d0a
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+)
+
+// Option codes
+const (
+	optEndOfOpt = 0
+	optComment  = 1
+	optUserAppl = 4 // in the section header block
+	optTSResol  = 9 // in the interface description block
+)
+
+const (
+	byteOrderMagic = 0x1a2b3c4d
+	// LinkTypeRaw is the link type of captures holding bare IP datagrams
+	LinkTypeRaw = 101
+	snapLen     = 65535
+	// tsResolNano is if_tsresol for nanoseconds, 10^-9
+	tsResolNano = 9
+)
+
+// ProbeComment is the comment of the probe sent with ttl, detail tells probes of the same TTL apart.
+func ProbeComment(ttl int, detail string) string {
+	return fmt.Sprintf("probe ttl=%d %s", ttl, detail)
+}
+
+// ReplyComment is the comment of the reply matched to the probe sent with ttl.
+func ReplyComment(ttl int, detail string) string {
+	return fmt.Sprintf("reply ttl=%d %s", ttl, detail)
+}
+
+// Writer writes a single section with one raw IP interface. It is safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter writes the section and interface headers to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	shb := make([]byte, 0, 32)
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	// section length is not known up front
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = appendOption(shb, optUserAppl, []byte("tracert"))
+	shb = appendOption(shb, optEndOfOpt, nil)
+
+	idb := make([]byte, 0, 20)
+	idb = binary.LittleEndian.AppendUint16(idb, LinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, snapLen)
+	idb = appendOption(idb, optTSResol, []byte{tsResolNano})
+	idb = appendOption(idb, optEndOfOpt, nil)
+
+	if err := writeBlock(w, blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+	if err := writeBlock(w, blockInterfaceDescription, idb); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes the IP datagram data seen at ts, with comment as its pkt_comment when not empty.
+func (w *Writer) WritePacket(ts time.Time, data []byte, comment string) error {
+	nanos := uint64(ts.UnixNano())
+	epb := make([]byte, 0, 20+len(data)+len(comment)+16)
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface id
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data))) // captured length
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data))) // original length
+	epb = append(epb, data...)
+	epb = pad(epb)
+	if comment != "" {
+		epb = appendOption(epb, optComment, []byte(comment))
+		epb = appendOption(epb, optEndOfOpt, nil)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeBlock(w.w, blockEnhancedPacket, epb)
+}
+
+// writeBlock frames body with the block type and the total length, repeated at both ends.
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	block := make([]byte, 0, total)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	_, err := w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+// pad aligns b to 32 bits as every field of a block must be.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package pcapng
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestWriterReadBack(t *testing.T) {
+	packets := []struct {
+		at      time.Time
+		data    []byte
+		comment string
+	}{
+		{time.Unix(1700000000, 123456789), []byte{0x45, 0, 0, 20, 1, 2, 3}, ProbeComment(3, "seq=3")},
+		{time.Unix(1700000000, 987654321), []byte{0x45, 0, 0, 20}, ReplyComment(3, "seq=3")},
+		{time.Unix(1700000001, 5), []byte{0x45}, ""},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.at, p.data, p.comment); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	if buf.Len()%4 != 0 {
+		t.Errorf("file is not 32 bit aligned: %d bytes", buf.Len())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("probe ttl=3 seq=3")) || !bytes.Contains(buf.Bytes(), []byte("reply ttl=3 seq=3")) {
+		t.Error("comments not written")
+	}
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("failed to read back: %v", err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("got link type: %v, want: raw", r.LinkType())
+	}
+	for i, p := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: failed to read: %v", i, err)
+		}
+		if !bytes.Equal(data, p.data) || !ci.Timestamp.Equal(p.at) {
+			t.Errorf("packet %d: got: %x at %v, want: %x at %v", i, data, ci.Timestamp, p.data, p.at)
+		}
+	}
+}
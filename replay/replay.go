@@ -0,0 +1,297 @@
+/*
+Package replay rebuilds traces from a packet capture taken while a traceroute was running, by this tool
+or any other. Probes are ICMP Echo Requests, TCP SYNs and UDP datagrams sent with a low TTL; their replies
+are found the way a live trace finds them: through the probe quoted in ICMP errors, the ID and sequence of
+Echo Replies and the ports and acknowledgement number of SYN-ACKs and RSTs.
+*/
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/monmohan/traceroute/asn"
+	"github.com/monmohan/traceroute/trace"
+	"github.com/monmohan/traceroute/tracebox"
+)
+
+// IP protocol numbers of the probes
+const (
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+var protoNames = map[uint8]string{protoICMP: "icmp", protoTCP: "tcp", protoUDP: "udp"}
+
+// pcapngMagic is the type of the section header block that starts every pcapng file
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// Options select what is rebuilt from the capture.
+type Options struct {
+	// Target limits the replay to probes sent to it, all probed destinations are rebuilt when nil
+	Target net.IP
+	// MaxHops is the highest probe TTL, packets sent with a larger one are ordinary traffic
+	MaxHops int
+	// Query annotates the hops, nil skips ASN lookups
+	Query asn.Query
+}
+
+// packetReader is what pcapgo's pcap and pcapng readers have in common
+type packetReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+/*
+flow identifies a probe by the fields its replies carry back: the destination and protocol,
+then the ICMP ID and sequence, or the ports and for TCP the sequence number.
+*/
+type flow struct {
+	dst   [4]byte
+	proto uint8
+	a, b  uint16
+	seq   uint32
+}
+
+type probe struct {
+	flow     flow
+	ttl      int
+	at       time.Time
+	datagram []byte
+	hop      *trace.Hop
+}
+
+// Replay reads a pcap or pcapng capture from r and returns one trace per probed destination, in the order they were first probed.
+func Replay(r io.Reader, opts Options) ([]*trace.Result, error) {
+	source, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxHops <= 0 {
+		opts.MaxHops = 64
+	}
+
+	probes := make(map[flow]*probe)
+	var order []*probe
+	for {
+		data, ci, err := source.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read capture: %v", err)
+		}
+		packet := gopacket.NewPacket(data, source.LinkType(), gopacket.Default)
+		ip4, ok := packet.NetworkLayer().(*layers.IPv4)
+		if !ok {
+			continue
+		}
+		datagram := append(append([]byte(nil), ip4.Contents...), ip4.Payload...)
+
+		if f, ok := probeFlow(datagram); ok {
+			if int(ip4.TTL) > opts.MaxHops || (opts.Target != nil && !opts.Target.Equal(ip4.DstIP)) {
+				continue
+			}
+			// the same probe can be captured twice, e.g. on the "any" interface
+			if _, seen := probes[f]; !seen {
+				p := &probe{flow: f, ttl: int(ip4.TTL), at: ci.Timestamp, datagram: datagram}
+				probes[f] = p
+				order = append(order, p)
+			}
+			continue
+		}
+		if f, ok := replyFlow(datagram); ok {
+			if p := probes[f]; p != nil && p.hop == nil {
+				p.hop = replyHop(p, datagram, ci.Timestamp)
+			}
+		}
+	}
+	return results(order, opts), nil
+}
+
+// open sniffs the capture format and returns a reader for it.
+func open(r io.Reader) (packetReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %v", err)
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		return pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	}
+	reader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, errors.New("not a pcap or pcapng capture")
+	}
+	return reader, nil
+}
+
+// header splits an IPv4 datagram into its header fields and transport bytes.
+func header(datagram []byte) (proto uint8, src, dst net.IP, transport []byte, ok bool) {
+	if len(datagram) < 20 || datagram[0]>>4 != 4 {
+		return 0, nil, nil, nil, false
+	}
+	ihl := int(datagram[0]&0x0f) * 4
+	if ihl < 20 || len(datagram) < ihl {
+		return 0, nil, nil, nil, false
+	}
+	return datagram[9], net.IP(datagram[12:16]), net.IP(datagram[16:20]), datagram[ihl:], true
+}
+
+// transportFlow is the flow of a probe given its destination and transport bytes, as little as 8 of them.
+func transportFlow(proto uint8, dst net.IP, t []byte) (flow, bool) {
+	f := flow{proto: proto}
+	copy(f.dst[:], dst.To4())
+	if len(t) < 8 {
+		return f, false
+	}
+	switch proto {
+	case protoICMP:
+		if t[0] != byte(layers.ICMPv4TypeEchoRequest) {
+			return f, false
+		}
+		f.a, f.b = binary.BigEndian.Uint16(t[4:]), binary.BigEndian.Uint16(t[6:])
+	case protoTCP:
+		f.a, f.b, f.seq = binary.BigEndian.Uint16(t[0:]), binary.BigEndian.Uint16(t[2:]), binary.BigEndian.Uint32(t[4:])
+	case protoUDP:
+		f.a, f.b = binary.BigEndian.Uint16(t[0:]), binary.BigEndian.Uint16(t[2:])
+	default:
+		return f, false
+	}
+	return f, true
+}
+
+// probeFlow recognises an outgoing probe: an Echo Request, a SYN or a UDP datagram.
+func probeFlow(datagram []byte) (flow, bool) {
+	proto, _, dst, t, ok := header(datagram)
+	if !ok {
+		return flow{}, false
+	}
+	if proto == protoTCP && (len(t) < 14 || t[13]&0x12 != 0x02) {
+		// only SYNs without ACK are probes
+		return flow{}, false
+	}
+	return transportFlow(proto, dst, t)
+}
+
+// replyFlow finds the flow of the probe a reply answers.
+func replyFlow(datagram []byte) (flow, bool) {
+	proto, src, _, t, ok := header(datagram)
+	if !ok {
+		return flow{}, false
+	}
+	switch proto {
+	case protoICMP:
+		if len(t) < 8 {
+			return flow{}, false
+		}
+		switch layers.ICMPv4TypeCode(binary.BigEndian.Uint16(t)).Type() {
+		case layers.ICMPv4TypeEchoReply:
+			echo := append([]byte{byte(layers.ICMPv4TypeEchoRequest)}, t[1:8]...)
+			return transportFlow(protoICMP, src, echo)
+		case layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeDestinationUnreachable:
+			qproto, _, qdst, qt, ok := header(t[8:])
+			if !ok {
+				return flow{}, false
+			}
+			return transportFlow(qproto, qdst, qt)
+		}
+	case protoTCP:
+		// SYN-ACK or RST, acknowledging the sequence number of the SYN
+		if len(t) < 14 || (t[13]&0x12 != 0x12 && t[13]&0x04 == 0) {
+			return flow{}, false
+		}
+		f := flow{proto: protoTCP, a: binary.BigEndian.Uint16(t[2:]), b: binary.BigEndian.Uint16(t[0:])}
+		f.seq = binary.BigEndian.Uint32(t[8:]) - 1
+		copy(f.dst[:], src.To4())
+		return f, true
+	}
+	return flow{}, false
+}
+
+// replyHop builds the hop for the reply to p, the same way the live probers do.
+func replyHop(p *probe, datagram []byte, at time.Time) *trace.Hop {
+	proto, src, _, t, _ := header(datagram)
+	hop := &trace.Hop{
+		TTL:      p.ttl,
+		Addr:     append(net.IP(nil), src.To4()...),
+		RTT:      at.Sub(p.at),
+		ReplyTTL: int(datagram[8]),
+	}
+	if proto != protoICMP {
+		hop.Destination = true
+		return hop
+	}
+	typ := layers.ICMPv4TypeCode(binary.BigEndian.Uint16(t)).Type()
+	switch typ {
+	case layers.ICMPv4TypeEchoReply:
+		hop.Destination = true
+	case layers.ICMPv4TypeDestinationUnreachable:
+		hop.Destination = src.Equal(net.IP(p.flow.dst[:]))
+		fallthrough
+	default:
+		hop.AddExtensions(t)
+		if sent, ok := tracebox.FromPacket(p.datagram); ok {
+			sent.Expired = typ == layers.ICMPv4TypeTimeExceeded
+			hop.CompareQuote(sent, t[8:])
+		}
+	}
+	return hop
+}
+
+/*
+results groups the probes by destination into traces, unanswered probes become timed out hops.
+Unless a target was asked for, destinations probed with a single TTL are left out, that is ordinary traffic.
+*/
+func results(order []*probe, opts Options) []*trace.Result {
+	byTarget := make(map[[4]byte]*trace.Result)
+	ttls := make(map[[4]byte]map[int]bool)
+	for _, p := range order {
+		if ttls[p.flow.dst] == nil {
+			ttls[p.flow.dst] = make(map[int]bool)
+		}
+		ttls[p.flow.dst][p.ttl] = true
+	}
+	var traces []*trace.Result
+	for _, p := range order {
+		if opts.Target == nil && len(ttls[p.flow.dst]) < 2 {
+			continue
+		}
+		result, ok := byTarget[p.flow.dst]
+		if !ok {
+			result = &trace.Result{Target: net.IP(append([]byte(nil), p.flow.dst[:]...)), Proto: protoNames[p.flow.proto]}
+			byTarget[p.flow.dst] = result
+			traces = append(traces, result)
+		}
+		hop := trace.Hop{TTL: p.ttl}
+		if p.hop != nil {
+			hop = *p.hop
+			hop.Annotate(opts.Query)
+			hop.InferReturnPath()
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+
+	for _, result := range traces {
+		sort.SliceStable(result.Hops, func(i, j int) bool { return result.Hops[i].TTL < result.Hops[j].TTL })
+		analyzer := trace.NewAnalyzer(result.Target)
+		for _, hop := range result.Hops {
+			analyzer.Add(hop)
+			result.Reached = result.Reached || hop.Destination
+		}
+		result.ASPath = trace.ASPath(result.Hops)
+		result.Anomalies = analyzer.Anomalies()
+	}
+	return traces
+}
@@ -0,0 +1,152 @@
+package replay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/monmohan/traceroute/pcapng"
+	"github.com/monmohan/traceroute/trace"
+)
+
+var (
+	local  = net.IPv4(192, 168, 1, 10).To4()
+	target = net.IPv4(93, 184, 216, 34).To4()
+	start  = time.Unix(1700000000, 0)
+)
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func ipv4(src, dst net.IP, ttl uint8, proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: ttl, Protocol: proto, SrcIP: src, DstIP: dst}
+}
+
+func syn(t *testing.T, ttl uint8) []byte {
+	ip := ipv4(local, target, ttl, layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(0xaa47 + int(ttl)), DstPort: 443, Seq: 1000 + uint32(ttl), SYN: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return serialize(t, ip, tcp)
+}
+
+func echo(t *testing.T, ttl uint8) []byte {
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 77, Seq: uint16(ttl)}
+	return serialize(t, ipv4(local, target, ttl, layers.IPProtocolICMPv4), icmp, gopacket.Payload("PING.."))
+}
+
+// timeExceeded quotes the first 28 bytes of probe, as RFC 792 asks, from router
+func timeExceeded(t *testing.T, router net.IP, probe []byte) []byte {
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}
+	return serialize(t, ipv4(router, local, 250, layers.IPProtocolICMPv4), icmp, gopacket.Payload(probe[:28]))
+}
+
+func TestReplayTCP(t *testing.T) {
+	type packet struct {
+		after time.Duration
+		data  []byte
+	}
+	routers := []net.IP{net.IPv4(192, 168, 1, 1), net.IPv4(10, 0, 0, 1)}
+	var packets []packet
+	for i, router := range routers {
+		ttl := uint8(i + 1)
+		probe := syn(t, ttl)
+		packets = append(packets, packet{time.Duration(ttl) * time.Second, probe})
+		packets = append(packets, packet{time.Duration(ttl)*time.Second + 5*time.Millisecond, timeExceeded(t, router, probe)})
+	}
+	// TTL 3 never answers, TTL 4 reaches the target
+	packets = append(packets, packet{3 * time.Second, syn(t, 3)})
+	packets = append(packets, packet{4 * time.Second, syn(t, 4)})
+	ip := ipv4(target, local, 60, layers.IPProtocolTCP)
+	synAck := &layers.TCP{SrcPort: 443, DstPort: 0xaa47 + 4, Seq: 5000, Ack: 1000 + 4 + 1, SYN: true, ACK: true}
+	synAck.SetNetworkLayerForChecksum(ip)
+	packets = append(packets, packet{4*time.Second + 20*time.Millisecond, serialize(t, ip, synAck)})
+	// ordinary traffic to another host, sent with a single TTL
+	dns := ipv4(local, net.IPv4(8, 8, 8, 8), 64, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(dns)
+	packets = append(packets, packet{5 * time.Second, serialize(t, dns, udp)})
+
+	var buf bytes.Buffer
+	w, err := pcapng.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("failed to create capture: %v", err)
+	}
+	for _, p := range packets {
+		w.WritePacket(start.Add(p.after), p.data, "")
+	}
+
+	results, err := Replay(&buf, Options{})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d traces, want 1", len(results))
+	}
+	r := results[0]
+	if !r.Target.Equal(target) || r.Proto != "tcp" || !r.Reached {
+		t.Errorf("unexpected trace: %s %s reached %v", r.Target, r.Proto, r.Reached)
+	}
+	want := []trace.Hop{
+		{TTL: 1, Addr: routers[0], RTT: 5 * time.Millisecond, ReplyTTL: 250},
+		{TTL: 2, Addr: routers[1], RTT: 5 * time.Millisecond, ReplyTTL: 250},
+		{TTL: 3},
+		{TTL: 4, Addr: target, RTT: 20 * time.Millisecond, ReplyTTL: 60, Destination: true},
+	}
+	if len(r.Hops) != len(want) {
+		t.Fatalf("got %d hops, want %d", len(r.Hops), len(want))
+	}
+	for i, h := range r.Hops {
+		w := want[i]
+		if h.TTL != w.TTL || !h.Addr.Equal(w.Addr) || h.RTT != w.RTT || h.ReplyTTL != w.ReplyTTL || h.Destination != w.Destination {
+			t.Errorf("hop %d: got: %d %v %v ttl %d dest %v, want: %d %v %v ttl %d dest %v", i,
+				h.TTL, h.Addr, h.RTT, h.ReplyTTL, h.Destination, w.TTL, w.Addr, w.RTT, w.ReplyTTL, w.Destination)
+		}
+	}
+	if r.Hops[0].InitialTTL != 255 || len(r.Hops[0].Modifications) != 0 {
+		t.Errorf("hop 1 not analysed like a live trace: %+v", r.Hops[0])
+	}
+}
+
+func TestReplayICMPPcap(t *testing.T) {
+	router := net.IPv4(10, 0, 0, 1)
+	probe1, probe2 := echo(t, 1), echo(t, 2)
+	reply := serialize(t, ipv4(target, local, 55, layers.IPProtocolICMPv4),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: 77, Seq: 2}, gopacket.Payload("PING.."))
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	w.WriteFileHeader(65535, layers.LinkTypeRaw)
+	for i, data := range [][]byte{probe1, timeExceeded(t, router, probe1), probe2, reply} {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+
+	results, err := Replay(&buf, Options{Target: target})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(results) != 1 || results[0].Proto != "icmp" || !results[0].Reached || len(results[0].Hops) != 2 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if h := results[0].Hops[0]; !h.Addr.Equal(router) || h.RTT != time.Millisecond {
+		t.Errorf("unexpected first hop: %+v", h)
+	}
+}
+
+func TestReplayInvalid(t *testing.T) {
+	if _, err := Replay(bytes.NewReader([]byte("definitely not a capture")), Options{}); err == nil {
+		t.Error("expected error for invalid capture")
+	}
+}
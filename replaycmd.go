@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/monmohan/traceroute/replay"
+)
+
+const replayUsage = "Usage: tracert replay [-target <ip>] [-maxHops <maxHops>] [-json] <capture.pcap[ng]>"
+
+// runReplay implements the replay subcommand, rebuilding the traces found in a capture file.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "Only rebuild the trace to this address, by default every traced destination is")
+	maxHops := fs.Int("maxHops", 64, "Highest TTL a probe can have, packets sent with a larger TTL are ignored")
+	jsonOut := fs.Bool("json", false, "Print the results as JSON on stdout, progress output goes to stderr")
+	loadASNFlags := asnFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println(replayUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	opts := replay.Options{MaxHops: *maxHops}
+	if *target != "" {
+		if opts.Target = net.ParseIP(*target).To4(); opts.Target == nil {
+			fmt.Println("Invalid target address:", *target)
+			os.Exit(1)
+		}
+	}
+
+	// with -json stdout is for the results only
+	out := io.Writer(os.Stdout)
+	if *jsonOut {
+		out = os.Stderr
+	}
+	opts.Query = loadASNFlags(out)
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, "Failed to open capture:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	results, err := replay.Replay(f, opts)
+	if err != nil {
+		fmt.Fprintln(out, "Failed to replay capture:", err)
+		os.Exit(1)
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(out, "No traceroute probes found in", fs.Arg(0))
+	}
+
+	for _, result := range results {
+		fmt.Fprintf(out, "Trace to %s (%s)\n", result.Target, result.Proto)
+		result.PrintHops(out)
+		result.PrintASPath(out)
+		result.PrintAnomalies(out)
+		fmt.Fprintln(out)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(out, "Failed to encode results:", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Package route asks the OS how it reaches a destination, which gives the source address and interface a
+trace should use. Nothing is sent: on Linux the route is looked up over netlink, elsewhere a UDP socket is
+connected to the destination.
+*/
+package route
+
+import (
+	"fmt"
+	"net"
+)
+
+// Route is how the OS reaches a destination.
+type Route struct {
+	// Src is the address packets to the destination leave with
+	Src net.IP
+	// Iface is the name of the outgoing interface, empty when the OS doesn't tell
+	Iface string
+	// Gateway is the next hop, nil when the destination is on link
+	Gateway net.IP
+}
+
+/*
+Lookup finds the route to dst for packets carrying the firewall mark, 0 for none. With iface set the route
+must leave through it, a VRF device selects its table. When the OS has no such route the first IPv4 address
+of iface is used as the source, so traces can be forced out of an interface.
+*/
+func Lookup(dst net.IP, iface string, mark int) (Route, error) {
+	if dst.To4() == nil {
+		return Route{}, fmt.Errorf("not an IPv4 address: %v", dst)
+	}
+	r, err := lookup(dst.To4(), iface, mark)
+	if iface != "" && (err != nil || r.Src == nil) {
+		src, ifaceErr := ifaceAddr(iface)
+		if ifaceErr != nil {
+			return Route{}, ifaceErr
+		}
+		return Route{Src: src, Iface: iface}, nil
+	}
+	if err != nil {
+		return Route{}, fmt.Errorf("failed to find route to %v: %v", dst, err)
+	}
+	if r.Src == nil {
+		return Route{}, fmt.Errorf("no source address for the route to %v", dst)
+	}
+	return r, nil
+}
+
+// ifaceAddr returns the first IPv4 address of the interface
+func ifaceAddr(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
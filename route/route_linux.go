@@ -0,0 +1,111 @@
+package route
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lookup sends an RTM_GETROUTE request for dst, restricted to iface and mark when set, and reads the route back
+func lookup(dst net.IP, iface string, mark int) (Route, error) {
+	oif := 0
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return Route{}, err
+		}
+		oif = ifi.Index
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return Route{}, err
+	}
+	defer syscall.Close(fd)
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Sendto(fd, request(dst, oif, mark), 0, kernel); err != nil {
+		return Route{}, err
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return Route{}, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return Route{}, err
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(m.Data) < 4 {
+				return Route{}, syscall.EINVAL
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return Route{}, syscall.Errno(errno)
+			}
+		case syscall.RTM_NEWROUTE:
+			return parse(&m)
+		}
+	}
+	return Route{}, syscall.ENETUNREACH
+}
+
+/*
+request is the RTM_GETROUTE message: a netlink header, the route message of a /32 IPv4 destination
+and its attributes, the destination address, and the outgoing interface and mark when they are set.
+*/
+func request(dst net.IP, oif int, mark int) []byte {
+	attrs := attr(syscall.RTA_DST, dst)
+	if oif > 0 {
+		attrs = append(attrs, attr(syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(oif)))...)
+	}
+	if mark != 0 {
+		attrs = append(attrs, attr(unix.RTA_MARK, binary.NativeEndian.AppendUint32(nil, uint32(mark)))...)
+	}
+	size := syscall.NLMSG_HDRLEN + syscall.SizeofRtMsg + len(attrs)
+	b := make([]byte, syscall.NLMSG_HDRLEN, size)
+	binary.NativeEndian.PutUint32(b[0:], uint32(size))
+	binary.NativeEndian.PutUint16(b[4:], syscall.RTM_GETROUTE)
+	binary.NativeEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(b[8:], 1)
+	rtmsg := make([]byte, syscall.SizeofRtMsg)
+	rtmsg[0] = syscall.AF_INET
+	rtmsg[1] = 32
+	return append(append(b, rtmsg...), attrs...)
+}
+
+// attr encodes a route attribute, the values used here are 4 bytes long so no padding is needed
+func attr(typ uint16, value []byte) []byte {
+	b := make([]byte, syscall.SizeofRtAttr, syscall.SizeofRtAttr+len(value))
+	binary.NativeEndian.PutUint16(b[0:], uint16(syscall.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(b[2:], typ)
+	return append(b, value...)
+}
+
+func parse(m *syscall.NetlinkMessage) (Route, error) {
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return Route{}, err
+	}
+	var r Route
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case syscall.RTA_PREFSRC:
+			r.Src = net.IP(a.Value).To4()
+		case syscall.RTA_GATEWAY:
+			r.Gateway = net.IP(a.Value).To4()
+		case syscall.RTA_OIF:
+			if len(a.Value) < 4 {
+				continue
+			}
+			if ifi, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(a.Value))); err == nil {
+				r.Iface = ifi.Name
+			}
+		}
+	}
+	return r, nil
+}
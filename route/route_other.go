@@ -0,0 +1,21 @@
+//go:build !linux
+
+package route
+
+import (
+	"net"
+)
+
+// lookup connects a UDP socket to dst, which makes the OS pick the source address without sending anything
+func lookup(dst net.IP, iface string, mark int) (Route, error) {
+	if iface != "" {
+		// the source can't be tied to an interface this way, Lookup falls back to its address
+		return Route{}, nil
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: 33434})
+	if err != nil {
+		return Route{}, err
+	}
+	defer conn.Close()
+	return Route{Src: conn.LocalAddr().(*net.UDPAddr).IP.To4()}, nil
+}
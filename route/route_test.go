@@ -0,0 +1,56 @@
+package route
+
+import (
+	"net"
+	"testing"
+)
+
+// loopback returns the name of the loopback interface
+func loopback(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %v", err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestLookup(t *testing.T) {
+	lo := loopback(t)
+	tests := []struct {
+		name  string
+		dst   net.IP
+		iface string
+	}{
+		{"loopback route", net.IPv4(127, 0, 0, 1), ""},
+		{"forced out of loopback", net.IPv4(127, 0, 0, 2), lo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Lookup(tt.dst, tt.iface, 0)
+			if err != nil {
+				t.Fatalf("failed to look up route: %v", err)
+			}
+			if !r.Src.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Errorf("got: %v, want: %v", r.Src, net.IPv4(127, 0, 0, 1))
+			}
+			if r.Iface != "" && r.Iface != lo {
+				t.Errorf("got: %v, want: %v", r.Iface, lo)
+			}
+		})
+	}
+}
+
+func TestLookupInvalid(t *testing.T) {
+	if _, err := Lookup(net.ParseIP("2001:db8::1"), "", 0); err == nil {
+		t.Error("expected error for IPv6 destination")
+	}
+	if _, err := Lookup(net.IPv4(127, 0, 0, 1), "no-such-iface0", 0); err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/server"
+	"github.com/monmohan/traceroute/trace"
+)
+
+const serveUsage = "Usage: tracert serve [-listen <addr>] [-max-running <n>] [-keep <n>] [-pps <n>] [trace flags]"
+
+// runServe implements the serve subcommand, running traces on demand through the HTTP API of package server.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "Address to serve the API on. Anyone who can reach it can send probes from this host")
+	maxRunning := fs.Int("max-running", 16, "Number of traces allowed to run at the same time, more are refused")
+	keep := fs.Int("keep", 1000, "Number of finished traces kept, the oldest are forgotten first")
+	pps := fs.Int("pps", 0, "Cap on the probes sent per second, across all traces. 0 for no cap")
+	newTracer := traceFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Println(serveUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// the ASN dataset is loaded here once, every trace shares it
+	t := newTracer(os.Stdout)
+	defer t.Close()
+	t.opts.Pacer = netio.NewPacer(*pps)
+	// the progress of concurrent traces interleaves, it is only shown with -verbose
+	if !t.opts.Verbose {
+		t.opts.Out = io.Discard
+	}
+
+	srv := server.New(func(req server.Request, onHop func(trace.Hop)) (*trace.Result, error) {
+		addr, err := net.ResolveIPAddr("ip4", req.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve IP address: %v", err)
+		}
+		opts := t.opts
+		opts.MaxHops, opts.Queries, opts.OnHop = req.MaxHops, req.Queries, onHop
+		result, err := t.run(addr, req.Proto, req.Port, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Trace of %s failed: %v\n", req.Target, err)
+		}
+		return result, err
+	}, server.Request{Proto: t.proto, Port: t.port, MaxHops: t.opts.MaxHops, Queries: t.opts.Queries})
+	srv.MaxRunning, srv.Keep = *maxRunning, *keep
+
+	fmt.Println("Serving the trace API on", *listen)
+	if err := http.ListenAndServe(*listen, srv); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to serve:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Package server is the HTTP API of tracert serve. Traces are started with POST /traces and looked up with
+GET /traces/{id}, GET /traces/{id}/events follows one as Server-Sent Events: a hop event for every hop as it
+is found, then a done event with the trace.
+*/
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monmohan/traceroute/trace"
+)
+
+// Request is the body of POST /traces, the fields left out take the server defaults
+type Request struct {
+	Target  string `json:"target"`
+	Proto   string `json:"proto,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	MaxHops int    `json:"maxHops,omitempty"`
+	Queries int    `json:"queries,omitempty"`
+}
+
+// TraceFunc runs the trace req asks for and calls onHop with every hop as it is found.
+type TraceFunc func(req Request, onHop func(trace.Hop)) (*trace.Result, error)
+
+// Trace statuses
+const (
+	Running = "running"
+	Done    = "done"
+	Failed  = "failed"
+)
+
+// Trace is a trace started through the API, as returned by GET /traces/{id}
+type Trace struct {
+	ID      string    `json:"id"`
+	Request Request   `json:"request"`
+	Status  string    `json:"status"`
+	Started time.Time `json:"started"`
+	Error   string    `json:"error,omitempty"`
+	// Hops are those found so far while the trace runs, once it is done Result has them all
+	Hops   []trace.Hop   `json:"hops,omitempty"`
+	Result *trace.Result `json:"result,omitempty"`
+}
+
+// entry is a trace and what its followers wait on
+type entry struct {
+	trace Trace
+	hops  []trace.Hop
+	// closed and replaced whenever a hop is found or the trace ends
+	changed chan struct{}
+}
+
+/*
+Server is the http.Handler of the API. Finished traces are kept until there are more than Keep of them,
+the oldest go first. Starting a trace while MaxRunning are running fails with 429 Too Many Requests.
+*/
+type Server struct {
+	Keep       int
+	MaxRunning int
+
+	run      TraceFunc
+	defaults Request
+
+	mu      sync.Mutex
+	traces  map[string]*entry
+	order   []string
+	running int
+}
+
+// New returns a Server running traces with run. defaults fill in what requests leave out.
+func New(run TraceFunc, defaults Request) *Server {
+	return &Server{Keep: 1000, MaxRunning: 16, run: run, defaults: defaults, traces: make(map[string]*entry)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /traces, /traces/{id} or /traces/{id}/events
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "traces" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "events") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.start(w, r)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.get(w, parts[1])
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		s.events(w, r, parts[1])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// start handles POST /traces, the trace runs in the background and its ID is returned right away
+func (s *Server) start(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if err := s.complete(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	if s.running >= s.MaxRunning {
+		s.mu.Unlock()
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("%d traces are already running", s.running))
+		return
+	}
+	s.running++
+	e := &entry{trace: Trace{ID: id, Request: req, Status: Running, Started: time.Now()}, changed: make(chan struct{})}
+	s.traces[id] = e
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	go s.trace(e)
+	w.Header().Set("Location", "/traces/"+id)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": id})
+}
+
+// complete fills in the defaults of req and checks it
+func (s *Server) complete(req *Request) error {
+	if req.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if req.Proto == "" {
+		req.Proto = s.defaults.Proto
+	}
+	if req.Proto != "icmp" && req.Proto != "tcp" {
+		return fmt.Errorf("invalid proto %q, want icmp or tcp", req.Proto)
+	}
+	if req.Proto == "tcp" && req.Port == 0 {
+		req.Port = s.defaults.Port
+	}
+	if req.Proto == "icmp" {
+		req.Port = 0
+	}
+	if req.MaxHops == 0 {
+		req.MaxHops = s.defaults.MaxHops
+	}
+	if req.Queries == 0 {
+		req.Queries = s.defaults.Queries
+	}
+	if req.Port < 0 || req.Port > 65535 || req.MaxHops < 1 || req.MaxHops > 255 || req.Queries < 1 || req.Queries > 10 {
+		return fmt.Errorf("invalid request, port is 1-65535, maxHops 1-255 and queries 1-10")
+	}
+	return nil
+}
+
+// trace runs e and records how it went
+func (s *Server) trace(e *entry) {
+	result, err := s.run(e.trace.Request, func(hop trace.Hop) {
+		s.mu.Lock()
+		e.hops = append(e.hops, hop)
+		s.notify(e)
+		s.mu.Unlock()
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if err != nil {
+		e.trace.Status, e.trace.Error = Failed, err.Error()
+	} else {
+		e.trace.Status, e.trace.Result = Done, result
+	}
+	s.notify(e)
+	s.evict()
+}
+
+// notify wakes up whoever follows e, s.mu must be held
+func (s *Server) notify(e *entry) {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// evict forgets the oldest finished traces beyond Keep, s.mu must be held
+func (s *Server) evict() {
+	finished := 0
+	for _, id := range s.order {
+		if s.traces[id].trace.Status != Running {
+			finished++
+		}
+	}
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if finished > s.Keep && s.traces[id].trace.Status != Running {
+			delete(s.traces, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+// snapshot returns the trace of e as it is now, s.mu must be held
+func (s *Server) snapshot(e *entry) Trace {
+	t := e.trace
+	if t.Status == Running {
+		t.Hops = append([]trace.Hop(nil), e.hops...)
+	}
+	return t
+}
+
+// get handles GET /traces/{id}
+func (s *Server) get(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	e, ok := s.traces[id]
+	var t Trace
+	if ok {
+		t = s.snapshot(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no trace "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// events handles GET /traces/{id}/events. The hops already found are sent first, then the others as they come.
+func (s *Server) events(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	e, ok := s.traces[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no trace "+id)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sent := 0
+	for {
+		s.mu.Lock()
+		hops := append([]trace.Hop(nil), e.hops[sent:]...)
+		t := s.snapshot(e)
+		changed := e.changed
+		s.mu.Unlock()
+
+		for _, hop := range hops {
+			if err := writeEvent(w, "hop", hop); err != nil {
+				return
+			}
+		}
+		sent += len(hops)
+		if t.Status != Running {
+			writeEvent(w, "done", t)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// newID returns a random trace ID, they can't be guessed to look up the traces of others
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate trace ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/monmohan/traceroute/trace"
+)
+
+var defaults = Request{Proto: "icmp", Port: 80, MaxHops: 64, Queries: 1}
+
+// stepTrace is a TraceFunc finding a hop each time step is sent to, the trace ends when it is closed
+func stepTrace(step chan struct{}) TraceFunc {
+	return func(req Request, onHop func(trace.Hop)) (*trace.Result, error) {
+		result := &trace.Result{Target: net.ParseIP(req.Target), Proto: req.Proto}
+		for range step {
+			hop := trace.Hop{TTL: len(result.Hops) + 1, Addr: net.IPv4(10, 0, 0, byte(len(result.Hops)+1))}
+			result.Hops = append(result.Hops, hop)
+			onHop(hop)
+		}
+		result.Reached = true
+		return result, nil
+	}
+}
+
+func post(t *testing.T, url string, body string) (*http.Response, map[string]string) {
+	resp, err := http.Post(url+"/traces", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	defer resp.Body.Close()
+	var v map[string]string
+	json.NewDecoder(resp.Body).Decode(&v)
+	return resp, v
+}
+
+func getTrace(t *testing.T, url string, id string) Trace {
+	resp, err := http.Get(url + "/traces/" + id)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer resp.Body.Close()
+	var tr Trace
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("failed to decode trace: %v", err)
+	}
+	return tr
+}
+
+func TestTrace(t *testing.T) {
+	step := make(chan struct{})
+	ts := httptest.NewServer(New(stepTrace(step), defaults))
+	defer ts.Close()
+
+	resp, v := post(t, ts.URL, `{"target": "93.184.216.34", "proto": "tcp", "maxHops": 10}`)
+	if resp.StatusCode != http.StatusAccepted || v["id"] == "" {
+		t.Fatalf("got: %d %v, want: %d and an ID", resp.StatusCode, v, http.StatusAccepted)
+	}
+	id := v["id"]
+	step <- struct{}{}
+
+	events, err := http.Get(ts.URL + "/traces/" + id + "/events")
+	if err != nil {
+		t.Fatalf("failed to follow trace: %v", err)
+	}
+	defer events.Body.Close()
+	if ct := events.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got: %v, want: text/event-stream", ct)
+	}
+	if tr := getTrace(t, ts.URL, id); tr.Status != Running || len(tr.Hops) != 1 || tr.Request.Port != 80 || tr.Request.Queries != 1 {
+		t.Errorf("got: %+v, want: running with 1 hop and the default port and queries", tr)
+	}
+	step <- struct{}{}
+	close(step)
+
+	// the hop found before following, the one after, then the end
+	var got []string
+	var done Trace
+	scanner := bufio.NewScanner(events.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			got = append(got, strings.TrimPrefix(line, "event: "))
+		}
+		if strings.HasPrefix(line, "data: ") && got[len(got)-1] == "done" {
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &done)
+		}
+	}
+	if strings.Join(got, " ") != "hop hop done" {
+		t.Errorf("got: %v, want: hop hop done", got)
+	}
+	if done.Status != Done || done.Result == nil || len(done.Result.Hops) != 2 || !done.Result.Reached {
+		t.Errorf("got: %+v, want: done with 2 hops", done)
+	}
+	if tr := getTrace(t, ts.URL, id); tr.Status != Done || tr.Hops != nil || tr.Result == nil {
+		t.Errorf("got: %+v, want: done with the result", tr)
+	}
+}
+
+func TestStartInvalid(t *testing.T) {
+	ts := httptest.NewServer(New(stepTrace(nil), defaults))
+	defer ts.Close()
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `target=example.com`},
+		{"no target", `{"proto": "icmp"}`},
+		{"unknown field", `{"target": "example.com", "ttl": 3}`},
+		{"invalid proto", `{"target": "example.com", "proto": "udp"}`},
+		{"too many hops", `{"target": "example.com", "maxHops": 300}`},
+		{"invalid port", `{"target": "example.com", "proto": "tcp", "port": 70000}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, v := post(t, ts.URL, tt.body); resp.StatusCode != http.StatusBadRequest || v["error"] == "" {
+				t.Errorf("got: %d %v, want: %d with an error", resp.StatusCode, v, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	step := make(chan struct{})
+	s := New(stepTrace(step), defaults)
+	s.Keep, s.MaxRunning = 1, 1
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, first := post(t, ts.URL, `{"target": "192.0.2.1"}`)
+	if resp, _ := post(t, ts.URL, `{"target": "192.0.2.2"}`); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got: %d, want: %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	close(step)
+
+	// once the first is done the second may start, and ending pushes the first out
+	var second map[string]string
+	for {
+		var resp *http.Response
+		if resp, second = post(t, ts.URL, `{"target": "192.0.2.2"}`); resp.StatusCode == http.StatusAccepted {
+			break
+		}
+	}
+	for getTrace(t, ts.URL, second["id"]).Status == Running {
+	}
+	resp, err := http.Get(ts.URL + "/traces/" + first["id"])
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got: %d, want: %d for an evicted trace", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	ts := httptest.NewServer(New(stepTrace(nil), defaults))
+	defer ts.Close()
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/", http.StatusNotFound},
+		{http.MethodGet, "/traces/0123", http.StatusNotFound},
+		{http.MethodGet, "/traces/0123/events", http.StatusNotFound},
+		{http.MethodGet, "/traces/0123/hops", http.StatusNotFound},
+		{http.MethodGet, "/traces", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/traces/0123", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got: %d, want: %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
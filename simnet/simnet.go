@@ -0,0 +1,153 @@
+/*
+Package simnet answers traceroute probes sent to a test prefix from a topology file, so the real binary can
+be run against fake targets. The prefix is routed to a TUN device, every datagram read from it is handed to
+the simulated network of its target, and the replies are written back once their latency has passed.
+*/
+package simnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/monmohan/traceroute/icmpext"
+	"github.com/monmohan/traceroute/netsim"
+)
+
+// topology is the file format, see the README for an example
+type topology struct {
+	Prefix  string   `json:"prefix"`
+	Seed    int64    `json:"seed"`
+	Targets []target `json:"targets"`
+}
+
+type target struct {
+	Addr      string   `json:"addr"`
+	Latency   string   `json:"latency"`
+	OpenPorts []int    `json:"open_ports"`
+	Routers   []router `json:"routers"`
+}
+
+type router struct {
+	Addr      string              `json:"addr"`
+	ECMP      []string            `json:"ecmp"`
+	Latency   string              `json:"latency"`
+	Loss      float64             `json:"loss"`
+	RateLimit int                 `json:"rate_limit"`
+	Silent    bool                `json:"silent"`
+	MPLS      []icmpext.MPLSLabel `json:"mpls"`
+	RemarkTOS *uint8              `json:"remark_tos"`
+}
+
+// Sim is a loaded topology, one simulated network per target.
+type Sim struct {
+	Prefix   *net.IPNet
+	Networks []*netsim.Network
+}
+
+// Load reads a topology file. Targets must be in its prefix, it is what gets routed to the simulator.
+func Load(r io.Reader) (*Sim, error) {
+	var t topology
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to parse topology: %v", err)
+	}
+	_, prefix, err := net.ParseCIDR(t.Prefix)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid prefix %q", t.Prefix)
+	}
+	if len(t.Targets) == 0 {
+		return nil, fmt.Errorf("topology has no targets")
+	}
+
+	sim := &Sim{Prefix: prefix}
+	for _, tgt := range t.Targets {
+		addr := parseIP(tgt.Addr)
+		if addr == nil || !prefix.Contains(addr) {
+			return nil, fmt.Errorf("target %q is not an address in %s", tgt.Addr, prefix)
+		}
+		latency, err := parseDuration(tgt.Latency)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", addr, err)
+		}
+		n := &netsim.Network{Target: netsim.Host{Addr: addr, Latency: latency, OpenPorts: tgt.OpenPorts}, Seed: t.Seed}
+		for i, r := range tgt.Routers {
+			router, err := r.compile()
+			if err != nil {
+				return nil, fmt.Errorf("target %s, router %d: %v", addr, i+1, err)
+			}
+			n.Routers = append(n.Routers, router)
+		}
+		sim.Networks = append(sim.Networks, n)
+	}
+	return sim, nil
+}
+
+func (r router) compile() (netsim.Router, error) {
+	router := netsim.Router{Loss: r.Loss, RateLimit: r.RateLimit, Silent: r.Silent, MPLS: r.MPLS, Remark: r.RemarkTOS}
+	// silent routers never answer, they don't need an address
+	if router.Addr = parseIP(r.Addr); router.Addr == nil && !r.Silent {
+		return router, fmt.Errorf("invalid address %q", r.Addr)
+	}
+	for _, a := range r.ECMP {
+		addr := parseIP(a)
+		if addr == nil {
+			return router, fmt.Errorf("invalid ECMP address %q", a)
+		}
+		router.ECMP = append(router.ECMP, addr)
+	}
+	if r.Loss < 0 || r.Loss > 1 {
+		return router, fmt.Errorf("loss %v is not between 0 and 1", r.Loss)
+	}
+	var err error
+	router.Latency, err = parseDuration(r.Latency)
+	return router, err
+}
+
+func parseIP(s string) net.IP {
+	return net.ParseIP(s).To4()
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid latency %q", s)
+	}
+	return d, nil
+}
+
+/*
+Serve answers the datagrams read from dev until reading fails. Replies are written from timers once their
+latency has passed, so a slow hop doesn't hold up the others.
+*/
+func (s *Sim) Serve(dev io.ReadWriter) error {
+	var mu sync.Mutex
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+		now := time.Now()
+		for _, network := range s.Networks {
+			reply, arrival, ok := network.Respond(datagram, now)
+			if !ok {
+				continue
+			}
+			time.AfterFunc(arrival.Sub(now), func() {
+				mu.Lock()
+				defer mu.Unlock()
+				dev.Write(reply)
+			})
+			break
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package simnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/monmohan/traceroute/netio"
+)
+
+func TestLoad(t *testing.T) {
+	f, err := os.Open("testdata/example.json")
+	if err != nil {
+		t.Fatalf("failed to open topology: %v", err)
+	}
+	defer f.Close()
+	sim, err := Load(f)
+	if err != nil {
+		t.Fatalf("failed to load topology: %v", err)
+	}
+	if sim.Prefix.String() != "198.18.0.0/24" || len(sim.Networks) != 2 {
+		t.Fatalf("unexpected topology: %v %d networks", sim.Prefix, len(sim.Networks))
+	}
+	n := sim.Networks[0]
+	if len(n.Routers) != 6 || n.Target.Latency != 42*time.Millisecond || len(n.Target.OpenPorts) != 2 {
+		t.Errorf("unexpected first target: %+v", n.Target)
+	}
+	if r := n.Routers[3]; len(r.ECMP) != 2 || r.Latency != 15*time.Millisecond {
+		t.Errorf("unexpected ECMP router: %+v", r)
+	}
+	if r := n.Routers[4]; len(r.MPLS) != 1 || r.MPLS[0].Label != 24001 || r.Remark == nil || *r.Remark != 0 {
+		t.Errorf("unexpected MPLS router: %+v", r)
+	}
+	if !n.Routers[2].Silent || n.Routers[5].RateLimit != 10 || n.Routers[1].Loss != 0.05 {
+		t.Errorf("router behaviour not loaded: %+v", n.Routers)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology string
+	}{
+		{"not json", `prefix: 198.18.0.0/24`},
+		{"unknown field", `{"prefix": "198.18.0.0/24", "targets": [{"addr": "198.18.0.1", "hops": 3}]}`},
+		{"bad prefix", `{"prefix": "198.18.0.0", "targets": [{"addr": "198.18.0.1"}]}`},
+		{"no targets", `{"prefix": "198.18.0.0/24"}`},
+		{"target outside prefix", `{"prefix": "198.18.0.0/24", "targets": [{"addr": "8.8.8.8"}]}`},
+		{"bad latency", `{"prefix": "198.18.0.0/24", "targets": [{"addr": "198.18.0.1", "latency": "fast"}]}`},
+		{"router without address", `{"prefix": "198.18.0.0/24", "targets": [{"addr": "198.18.0.1", "routers": [{"latency": "1ms"}]}]}`},
+		{"bad loss", `{"prefix": "198.18.0.0/24", "targets": [{"addr": "198.18.0.1", "routers": [{"addr": "10.0.0.1", "loss": 5}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(strings.NewReader(tt.topology)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+// device is a TUN device fed from a channel, its writes go to another one
+type device struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (d *device) Read(b []byte) (int, error) {
+	p, ok := <-d.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (d *device) Write(b []byte) (int, error) {
+	d.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestServe(t *testing.T) {
+	sim, err := Load(strings.NewReader(`{"prefix": "198.18.0.0/24", "targets": [
+		{"addr": "198.18.0.10", "latency": "5ms", "routers": [{"addr": "4.69.140.1", "latency": "1ms"}]}]}`))
+	if err != nil {
+		t.Fatalf("failed to load topology: %v", err)
+	}
+	prober := net.IPv4(192, 168, 1, 10).To4()
+	echo := func(ttl int, dst net.IP) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: uint16(ttl)}
+		gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, icmp)
+		d, _ := netio.Datagram(prober, dst, layers.IPProtocolICMPv4, ttl, buf.Bytes())
+		return d
+	}
+
+	dev := &device{in: make(chan []byte, 3), out: make(chan []byte, 3)}
+	// the reply to the later probe arrives first, it comes from a closer hop
+	dev.in <- echo(2, net.IPv4(198, 18, 0, 10))
+	dev.in <- echo(1, net.IPv4(198, 18, 0, 10))
+	dev.in <- echo(1, net.IPv4(198, 18, 0, 99))
+	close(dev.in)
+	if err := sim.Serve(dev); err != io.EOF {
+		t.Fatalf("got: %v, want: %v", err, io.EOF)
+	}
+
+	want := []net.IP{net.IPv4(4, 69, 140, 1), net.IPv4(198, 18, 0, 10)}
+	for _, src := range want {
+		select {
+		case reply := <-dev.out:
+			ip := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default).NetworkLayer().(*layers.IPv4)
+			if !ip.SrcIP.Equal(src) || !ip.DstIP.Equal(prober) {
+				t.Errorf("got: %v -> %v, want: %v -> %v", ip.SrcIP, ip.DstIP, src, prober)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no reply from %v", src)
+		}
+	}
+	select {
+	case reply := <-dev.out:
+		t.Errorf("unexpected reply %x for an address outside the topology", reply)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,70 @@
+package simnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrRPFilter is returned with a working device when net.ipv4.conf.all.rp_filter will drop the routers' replies
+var ErrRPFilter = errors.New("net.ipv4.conf.all.rp_filter is on, router replies will be dropped")
+
+// TUN is a TUN device carrying raw IPv4 datagrams, without packet information headers.
+type TUN struct {
+	*os.File
+	Name string
+}
+
+/*
+OpenTUN creates the TUN device name, or lets the kernel pick one when empty, brings it up and routes prefix
+to it. The device and its route disappear when it is closed. Replies come from router addresses that are
+routed elsewhere and the device has no address of its own, so reverse path filtering is turned off on it.
+The kernel applies the stricter of the device and the "all" setting, the error says when the latter is on.
+*/
+func OpenTUN(name string, prefix *net.IPNet) (*TUN, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+	// struct ifreq: the name followed by the flags
+	var ifr [unix.IFNAMSIZ + 24]byte
+	copy(ifr[:unix.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = unix.IFF_TUN | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device: %v", errno)
+	}
+	// non-blocking so reads go through the runtime poller and Close interrupts them
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	name = string(ifr[:bytes.IndexByte(ifr[:], 0)])
+	tun := &TUN{File: os.NewFile(uintptr(fd), "/dev/net/tun"), Name: name}
+
+	cmds := [][]string{
+		{"link", "set", "dev", name, "up"},
+		{"route", "add", prefix.String(), "dev", name},
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			tun.Close()
+			return nil, fmt.Errorf("failed to run ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv4/conf/"+name+"/rp_filter", []byte("0"), 0644); err != nil {
+		tun.Close()
+		return nil, fmt.Errorf("failed to turn off reverse path filtering: %v", err)
+	}
+	if all, err := os.ReadFile("/proc/sys/net/ipv4/conf/all/rp_filter"); err == nil && strings.TrimSpace(string(all)) != "0" {
+		return tun, ErrRPFilter
+	}
+	return tun, nil
+}
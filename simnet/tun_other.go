@@ -0,0 +1,20 @@
+//go:build !linux
+
+package simnet
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// TUN is a TUN device carrying raw IPv4 datagrams, without packet information headers.
+type TUN struct {
+	*os.File
+	Name string
+}
+
+// OpenTUN is only implemented on Linux.
+func OpenTUN(name string, prefix *net.IPNet) (*TUN, error) {
+	return nil, errors.New("TUN devices are only supported on Linux")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/monmohan/traceroute/simnet"
+)
+
+const simnetUsage = "Usage: tracert simnet [-dev <name>] <topology.json>"
+
+// runSimnet implements the simnet subcommand, answering probes to the topology's prefix until interrupted.
+func runSimnet(args []string) {
+	fs := flag.NewFlagSet("simnet", flag.ExitOnError)
+	dev := fs.String("dev", "simnet0", "Name of the TUN device to create")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println(simnetUsage)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Failed to open topology:", err)
+		os.Exit(1)
+	}
+	sim, err := simnet.Load(f)
+	f.Close()
+	if err != nil {
+		fmt.Println("Failed to load topology:", err)
+		os.Exit(1)
+	}
+
+	tun, err := simnet.OpenTUN(*dev, sim.Prefix)
+	if errors.Is(err, simnet.ErrRPFilter) {
+		fmt.Println("Warning:", err, "- set it to 0 to see the routers")
+	} else if err != nil {
+		fmt.Println("Failed to set up TUN device:", err)
+		os.Exit(1)
+	}
+	defer tun.Close()
+	fmt.Printf("Routing %s to %s\n", sim.Prefix, tun.Name)
+	for _, n := range sim.Networks {
+		fmt.Printf("  %-15s %d hops\n", n.Target.Addr, len(n.Routers)+1)
+	}
+	if err := sim.Serve(tun); err != nil {
+		fmt.Println("Failed to read from TUN device:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,164 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/monmohan/traceroute/netio"
+)
+
+// pollInterval bounds how long the capture blocks, so it notices when the connection is closed
+const pollInterval = 250 * time.Millisecond
+
+/*
+captureConn sends SYNs on raw IP sockets and receives through a pcap capture, which also sees the SYNs leave.
+Capture timestamps are kept, they are more accurate than timing the reads.
+*/
+type captureConn struct {
+	laddr   net.IP
+	opts    netio.SocketOptions
+	packets chan netio.Packet
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+var _ netio.Conn = (*captureConn)(nil)
+
+// openCapture starts capturing on dev what matches filter. The SYNs are sent from laddr with opts applied.
+func openCapture(dev string, filter string, laddr net.IP, opts netio.SocketOptions) (*captureConn, error) {
+	handle, err := pcap.OpenLive(dev, 1600, false, pollInterval)
+	if err != nil {
+		return nil, err
+	}
+	// Set BPF filter
+	err = handle.SetBPFFilter(filter)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	c := &captureConn{laddr: laddr, opts: opts, packets: make(chan netio.Packet, 64), closed: make(chan struct{})}
+	go func() {
+		defer handle.Close()
+		c.capture(gopacket.NewPacketSource(handle, handle.LinkType()))
+	}()
+	return c, nil
+}
+
+// packetSource is where captured packets are read from, a gopacket.PacketSource
+type packetSource interface {
+	NextPacket() (gopacket.Packet, error)
+}
+
+/*
+capture feeds the IPv4 datagrams read from source to Receive until the connection is closed. A capture that
+can't be read anymore, e.g. because its device went away, closes the connection. Timeouts and EAGAIN are
+retried after pollInterval, so they don't spin.
+*/
+func (c *captureConn) capture(source packetSource) {
+	for {
+		packet, err := source.NextPacket()
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		// the read already waited pollInterval
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			var nerr net.Error
+			if !errors.Is(err, syscall.EAGAIN) && !(errors.As(err, &nerr) && nerr.Timeout()) {
+				c.Close()
+				return
+			}
+			select {
+			case <-time.After(pollInterval):
+			case <-c.closed:
+				return
+			}
+			continue
+		}
+		ip4, ok := packet.NetworkLayer().(*layers.IPv4)
+		if !ok {
+			continue
+		}
+		p := netio.Packet{Data: append(append([]byte(nil), ip4.Contents...), ip4.Payload...), At: packet.Metadata().Timestamp}
+		select {
+		case c.packets <- p:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *captureConn) Send(dst net.IP, ttl int, payload []byte) error {
+	// bound to the source the checksum was computed with
+	dialer := net.Dialer{LocalAddr: &net.IPAddr{IP: c.laddr}, Control: c.opts.Control}
+	conn, err := dialer.Dial("ip4:tcp", dst.String())
+	if err != nil {
+		return err
+	}
+	ipConn := conn.(*net.IPConn)
+	defer ipConn.Close()
+	/*
+		The IP header is created by the OS, we can't set its TTL directly.
+		Instead have to use raw sockets to set TTL.
+	*/
+	file, err := ipConn.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.SetsockoptInt(int(file.Fd()), syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil {
+		return err
+	}
+	_, err = ipConn.Write(payload)
+	return err
+}
+
+func (c *captureConn) Receive() (netio.Packet, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-c.packets:
+		return p, nil
+	case <-expired:
+		return netio.Packet{}, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return netio.Packet{}, net.ErrClosed
+	}
+}
+
+func (c *captureConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *captureConn) LocalAddr() net.IP {
+	return c.laddr
+}
+
+func (c *captureConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
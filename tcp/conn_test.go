@@ -0,0 +1,60 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/monmohan/traceroute/netio"
+)
+
+// erringSource fails every read with err, counting them
+type erringSource struct {
+	err   error
+	reads int
+}
+
+func (s *erringSource) NextPacket() (gopacket.Packet, error) {
+	s.reads++
+	return nil, s.err
+}
+
+func TestCaptureErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		closes bool
+	}{
+		{"end of capture", io.EOF, true},
+		{"device gone", pcap.NextErrorReadError, true},
+		{"EAGAIN", syscall.EAGAIN, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &captureConn{packets: make(chan netio.Packet, 1), closed: make(chan struct{})}
+			source := &erringSource{err: tt.err}
+			stopped := make(chan struct{})
+			go func() {
+				c.capture(source)
+				close(stopped)
+			}()
+
+			c.SetReadDeadline(time.Now().Add(3 * pollInterval))
+			_, err := c.Receive()
+			if got := errors.Is(err, net.ErrClosed); got != tt.closes {
+				t.Errorf("got: %v, want closed: %v", err, tt.closes)
+			}
+			c.Close()
+			<-stopped
+			// retries wait pollInterval instead of spinning
+			if !tt.closes && source.reads > 4 {
+				t.Errorf("got %d reads in %v", source.reads, 3*pollInterval)
+			}
+		})
+	}
+}
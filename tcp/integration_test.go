@@ -0,0 +1,104 @@
+//go:build integration && linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/monmohan/traceroute/netns"
+	"github.com/monmohan/traceroute/trace"
+)
+
+// buildChain builds topology for the test, skipping it where namespaces or netem can't be set up
+func buildChain(t *testing.T, topology netns.Topology) *netns.Chain {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	chain, err := netns.Build(topology)
+	if errors.Is(err, netns.ErrNetem) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("failed to build topology: %v", err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+func TestTraceNetns(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = time.Second
+
+	topology := netns.Topology{
+		Routers: []netns.Link{{Delay: 10 * time.Millisecond}, {}, {Delay: 20 * time.Millisecond}},
+		Target:  netns.Link{Delay: 5 * time.Millisecond},
+	}
+	chain := buildChain(t, topology)
+	var listener net.Listener
+	err := chain.InTarget(func() (err error) {
+		listener, err = net.Listen("tcp", ":8443")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to listen in target namespace: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		port int
+	}{
+		{"listening port answers with SYN-ACK", 8443},
+		{"closed port answers with RST", 8444},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result *trace.Result
+			err := chain.InProber(func() error {
+				var err error
+				result, err = Trace(netns.Device, &net.IPAddr{IP: chain.Target}, tt.port, trace.Options{MaxHops: 10, Queries: 1, Src: chain.Source})
+				return err
+			})
+			if err != nil {
+				t.Fatalf("failed to trace from the prober namespace: %v", err)
+			}
+			if !result.Reached {
+				t.Fatal("trace did not reach the target")
+			}
+			want := append(append([]net.IP(nil), chain.Routers...), chain.Target)
+			if len(result.Hops) != len(want) {
+				t.Fatalf("got %d hops, want %d", len(result.Hops), len(want))
+			}
+			links := append(append([]netns.Link(nil), topology.Routers...), topology.Target)
+			var minRTT time.Duration
+			for i, h := range result.Hops {
+				minRTT += links[i].Delay
+				if h.TTL != i+1 || !h.Addr.Equal(want[i]) {
+					t.Errorf("hop %d: got: %d %v, want: %d %v", i, h.TTL, h.Addr, i+1, want[i])
+				}
+				if h.RTT < minRTT || h.RTT > minRTT+time.Second {
+					t.Errorf("hop %d: got: %v, want: between %v and %v", i, h.RTT, minRTT, minRTT+time.Second)
+				}
+				if len(h.Modifications) != 0 {
+					t.Errorf("hop %d: unexpected modifications %v", i, h.Modifications)
+				}
+			}
+			if !result.Hops[len(want)-1].Destination {
+				t.Error("last hop is not the destination")
+			}
+		})
+	}
+}
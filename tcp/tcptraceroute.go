@@ -1,101 +1,290 @@
 package tcp
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
-	"syscall"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/pcapng"
+	"github.com/monmohan/traceroute/trace"
+	"github.com/monmohan/traceroute/tracebox"
 )
 
-const timeout = time.Duration(10 * time.Second)
+// timeout is how long the prober and the listener wait for each other
+var timeout = time.Duration(10 * time.Second)
+
+// prober runs one trace, everything it needs is here so traces can run concurrently
+type prober struct {
+	conn netio.Conn
+	// portBase is the source port of the probe with TTL 0, each probe uses portBase + TTL
+	portBase int
+	target   net.IP
+	// port is the destination port of the probes
+	port uint16
+	opts trace.Options
+
+	// mu guards the probe in flight, the listener matches what it captures against it
+	mu      sync.Mutex
+	current syn
+	// earlier are the sequence numbers of the probes sent before current, what quotes them is a late reply
+	earlier map[uint32]bool
+}
+
+func (p *prober) debugPrint(v ...interface{}) {
+	if p.opts.Verbose {
+		fmt.Fprintln(p.opts.Output(), v...)
+	}
+}
+
+/*
+Every trace has a block of 256 source ports, from portRange. The TTL of each probe is in the low byte, the block
+says which trace it belongs to. 128 traces can run at the same time.
+*/
+const (
+	portRange  = 0x8000
+	portBlocks = 128
+)
+
+// blockOffset keeps the port blocks of different processes apart, their captures all see every probe
+var blockOffset = os.Getpid() % portBlocks
 
-var dbg bool
+// NewMux starts capturing on iface, all interfaces when it is empty, to be shared by the traces run with TraceOn.
+// Their SYNs are sent from src with socket applied.
+func NewMux(iface string, src net.IP, socket netio.SocketOptions) (*netio.Mux, error) {
+	if iface == "" {
+		iface = "any"
+	}
+	conn, err := openCapture(iface, fmt.Sprintf("icmp or (tcp and portrange %d-%d)", portRange, portRange+portBlocks*256-1), src, socket)
+	if err != nil {
+		return nil, err
+	}
+	return netio.NewMux(conn, portBlocks, demux), nil
+}
+
+// portBase is the source port of the probe with TTL 0 of the trace holding key
+func portBase(key int) int {
+	return portRange + (key+blockOffset)%portBlocks*256
+}
 
-func debugPrint(v ...interface{}) {
-	if dbg {
-		fmt.Println(v...)
+/*
+demux finds the key of the trace a captured packet belongs to from the source port of the probe: that of our
+own SYNs, the destination port of what the target answers and the source port of the SYN quoted in ICMP errors.
+*/
+func demux(datagram []byte) (int, bool) {
+	if len(datagram) < 20 {
+		return 0, false
 	}
+	payload := datagram[int(datagram[0]&0x0f)*4:]
+	var port uint16
+	switch layers.IPProtocol(datagram[9]) {
+	case layers.IPProtocolTCP:
+		if len(payload) < 14 {
+			return 0, false
+		}
+		port = binary.BigEndian.Uint16(payload[2:4])
+		// SYN without ACK
+		if payload[13]&0x12 == 0x02 {
+			port = binary.BigEndian.Uint16(payload[0:2])
+		}
+	case layers.IPProtocolICMPv4:
+		if len(payload) < 28 || layers.IPProtocol(payload[8+9]) != layers.IPProtocolTCP {
+			return 0, false
+		}
+		quoted := payload[8:]
+		segment := quoted[int(quoted[0]&0x0f)*4:]
+		if len(segment) < 2 {
+			return 0, false
+		}
+		port = binary.BigEndian.Uint16(segment)
+	default:
+		return 0, false
+	}
+	if port < portRange {
+		return 0, false
+	}
+	block := int(port-portRange) / 256
+	return (block - blockOffset + portBlocks) % portBlocks, true
 }
 
-func Trace(iface string, verbose bool, maxHops int, ipAddr *net.IPAddr, port int) {
+/*
+Trace runs a TCP SYN traceroute to ipAddr:port as set up by opts, on a capture of its own. Replies are captured
+on iface, or all interfaces when it is empty. An error is returned if the capture can't be started.
+Probing stops at the destination or once a routing loop is confirmed.
+*/
+func Trace(iface string, ipAddr *net.IPAddr, port int, opts trace.Options) (*trace.Result, error) {
+	mux, err := NewMux(iface, opts.Src, opts.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer mux.Close()
+	return TraceOn(mux, ipAddr, port, opts)
+}
 
-	dbg = verbose
+/*
+TraceOn runs a TCP SYN traceroute to ipAddr:port through mux, alongside the other traces on it. Its probes are
+sent from a block of source ports of their own, which is how the replies are told apart. opts.Src and
+opts.Socket must be those mux was opened with.
+*/
+func TraceOn(mux *netio.Mux, ipAddr *net.IPAddr, port int, opts trace.Options) (*trace.Result, error) {
+	conn, err := mux.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return traceConn(conn, conn.Key, ipAddr, port, opts), nil
+}
 
+// traceConn probes ipAddr:port through conn from the port block of key, TraceOn runs it on a capture shared through a Mux
+func traceConn(conn netio.Conn, key int, ipAddr *net.IPAddr, port int, opts trace.Options) *trace.Result {
+	p := &prober{conn: conn, portBase: portBase(key), target: ipAddr.IP, port: uint16(port), opts: opts, earlier: make(map[uint32]bool)}
 	//set up sync channels
 	icmpChan := make(chan struct{})
-	tcpChan := make(chan struct{})
-	done := make(chan struct{})
+	hopChan := make(chan reply)
+	// buffered so the listener can always signal its exit, even after probing is over
+	done := make(chan struct{}, 1)
+	// closed once probing is over, probes can be held back by the pacer for longer than timeout
+	stop := make(chan struct{})
+
+	go p.setUpICMPListener(icmpChan, hopChan, done, stop)
+	result := p.probe(icmpChan, hopChan, done)
+	close(stop)
+	result.ASPath = trace.ASPath(result.Hops)
+
+	fmt.Fprintln(p.opts.Output(), "Done..")
+	return result
+}
 
-	go setUpICMPListener(iface, fmt.Sprintf("icmp or (tcp  and host %s)", ipAddr), icmpChan, tcpChan, done)
-	go probe(ipAddr, uint16(port), maxHops, icmpChan, tcpChan, done)
+/*
+syn is a probe as sent. All the queries at a TTL go out from the same source port, their replies are told apart
+by the sequence number: that quoted in ICMP errors, the one acknowledged by the target.
+*/
+type syn struct {
+	ttl int
+	seq uint32
+}
 
-	<-done
-	fmt.Println("Done..")
+// send makes s the probe in flight
+func (p *prober) send(s syn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current.ttl != 0 {
+		p.earlier[p.current.seq] = true
+	}
+	p.current = s
+}
 
+// inFlight returns the last probe sent, and whether seq is that of one sent before it
+func (p *prober) inFlight(seq uint32) (syn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current, p.earlier[seq]
 }
 
-func probe(addr *net.IPAddr, port uint16, maxHops int, icmpChan chan struct{}, tcpChan chan struct{}, done chan struct{}) error {
-	//run probe with TTL 1 to 10
-	for i := 1; i < maxHops; i++ {
-		err := sendSyn(addr, port, i)
-		if err != nil {
-			debugPrint("Failed to probe:", err)
+// reply is what the listener captured in response to a probe
+type reply struct {
+	hop     trace.Hop
+	at      time.Time
+	reached bool
+}
 
-		}
+// probeMSS is advertised in every SYN so MSS clamping on the path shows up in the quoted headers
+const probeMSS = 1460
+
+func (p *prober) probe(icmpChan chan struct{}, hopChan chan reply, done chan struct{}) *trace.Result {
+	result := &trace.Result{Target: p.target, Proto: "tcp"}
+	analyzer := trace.NewAnalyzer(p.target)
+	defer func() { result.Anomalies = analyzer.Anomalies() }()
+	//run probe with TTL 1 to maxHops
+	for i := 1; i < p.opts.MaxHops; i++ {
+		for q := 0; q < p.opts.Queries; q++ {
+			p.opts.Pacer.Wait()
+			sent := time.Now()
+			err := p.sendSyn(i)
+			if err != nil {
+				p.debugPrint("Failed to probe:", err)
 
-		select {
-		case icmpChan <- struct{}{}: // Signal ICMP request send
-			debugPrint("TCP Probe: Signaled ICMP Channel")
-		case <-time.After(timeout):
-			debugPrint("TCP Send: Timeout while signaling ICMP Channel, continue probe")
+			}
 
-		}
-		debugPrint("\n--------------------------------------------------")
-		select {
-		case <-tcpChan: // Wait for ICMP Packet Read
-			debugPrint("TCP Send: Received ICMP Channel Signal")
-		case <-time.After(timeout):
-			fmt.Println("  * * * Timeout while waiting for ICMP Packet * * * ")
-			debugPrint("TCP Send: Timeout while waiting for ICMP Channel, continue to next probe")
+			select {
+			case icmpChan <- struct{}{}: // Signal ICMP request send
+				p.debugPrint("TCP Probe: Signaled ICMP Channel")
+			case <-done:
+				p.debugPrint("TCP Send: ICMP Listener exited, stop probing")
+				return result
+			case <-time.After(timeout):
+				p.debugPrint("TCP Send: Timeout while signaling ICMP Channel, continue probe")
 
+			}
+			p.debugPrint("\n--------------------------------------------------")
+			hop := trace.Hop{TTL: i}
+			select {
+			case r := <-hopChan: // Wait for ICMP Packet Read
+				p.debugPrint("TCP Send: Received ICMP Channel Signal")
+				hop = r.hop
+				if hop.TTL == 0 {
+					hop.TTL = i
+				}
+				hop.RTT = r.at.Sub(sent)
+				hop.Destination = r.reached
+				p.annotateHop(&hop)
+			case <-done:
+				p.debugPrint("TCP Send: ICMP Listener exited, stop probing")
+				return result
+			case <-time.After(timeout):
+				fmt.Fprintln(p.opts.Output(), "  * * * Timeout while waiting for ICMP Packet * * * ")
+				p.debugPrint("TCP Send: Timeout while waiting for ICMP Channel, continue to next probe")
+
+			}
+			result.Hops = append(result.Hops, hop)
+			if p.opts.OnHop != nil {
+				p.opts.OnHop(hop)
+			}
+			loop := analyzer.Add(hop)
+			if hop.Destination {
+				result.Reached = true
+				return result
+			}
+			if loop {
+				fmt.Fprintln(p.opts.Output(), "Routing loop detected, stop probing")
+				return result
+			}
 		}
 
 	}
-	done <- struct{}{}
-	return nil
+	return result
 
 }
 
-func sendSyn(destIp *net.IPAddr, port uint16, ttl int) error {
-	//ipConn, err := net.Dial("ip4:tcp", destIp.String())
-	ipConn, err := net.DialIP("ip4:tcp", nil, &net.IPAddr{IP: destIp.IP})
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer ipConn.Close()
-
-	// Create IP layer
+// sendSyn sends a SYN with ttl to the probed port, it is in flight from then on
+func (p *prober) sendSyn(ttl int) error {
+	// The IP layer is only needed for the checksum, the OS adds the real one
 	ip := &layers.IPv4{
-		SrcIP:    GetOutboundIP(),
-		DstIP:    destIp.IP,
+		SrcIP:    p.conn.LocalAddr(),
+		DstIP:    p.target,
 		Protocol: layers.IPProtocolTCP,
 	}
 
 	tcp := &layers.TCP{
 		//Generate random port number each time
-		SrcPort: layers.TCPPort(0xaa47 + uint16(ttl)),
-		DstPort: layers.TCPPort(port),
+		SrcPort: layers.TCPPort(p.portBase + ttl),
+		DstPort: layers.TCPPort(p.port),
 		Seq:     rand.Uint32(),
 		SYN:     true,
 		Window:  65535,
 		Urgent:  0,
-		Options: []layers.TCPOption{},
+		Options: []layers.TCPOption{{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   binary.BigEndian.AppendUint16(nil, probeMSS),
+		}},
 	}
 	tcp.SetNetworkLayerForChecksum(ip)
 
@@ -109,78 +298,49 @@ func sendSyn(destIp *net.IPAddr, port uint16, ttl int) error {
 		Why not serialize IP packet along with TCP packet?
 		When we serialized both IP and TCP layers, we were essentially creating an IP packet inside another IP packet.
 		The outer IP packet (added by the OS) contained our entire serialized packet as its payload,
-		leading to incorrect packet structure. Since the IP packet is created by the OS, we can't set its TTL direclty.
-		Instead have to use raw sockets to set TTL.
+		leading to incorrect packet structure.
 	*/
-	err = gopacket.SerializeLayers(buf, opts, tcp)
+	err := gopacket.SerializeLayers(buf, opts, tcp)
 	if err != nil {
 		return err
 	}
-	file, err := ipConn.File()
-	if err != nil {
+	p.send(syn{ttl: ttl, seq: tcp.Seq})
+	if err := p.conn.Send(p.target, ttl, buf.Bytes()); err != nil {
 		return err
 	}
-	syscall.SetsockoptInt(int(file.Fd()), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
 
-	_, err = ipConn.Write(buf.Bytes())
-
-	if err != nil {
-		return err
-	}
-
-	fmt.Print("Packet sent with TTL : ", ttl)
+	fmt.Fprint(p.opts.Output(), "Packet sent with TTL : ", ttl)
 
 	return nil
 
 }
 
-func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-	return localAddr.IP
-}
-
-func setUpICMPListener(dev string, filter string, icmpChan chan struct{}, tcpChan chan struct{}, done chan struct{}) {
-	handle, err := pcap.OpenLive(dev, 1600, false, pcap.BlockForever)
-	// print what is captured
-	debugPrint("Capturing packets on interface", dev)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer handle.Close()
-	// Set BPF filter
-	err = handle.SetBPFFilter(filter)
-	debugPrint("Filter set to", filter)
-	if err != nil {
-		log.Fatal(err)
-	}
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+func (p *prober) setUpICMPListener(icmpChan chan struct{}, hopChan chan reply, done chan struct{}, stop chan struct{}) {
+	// our own SYNs as they left, by source port, to compare with what the routers quote back
+	sent := make(map[uint16]tracebox.Probe)
 
 	for {
 		select {
 		case <-icmpChan: // Wait for TCP request send
-			debugPrint("ICMP Listener: Received TCP Channel Signal")
-		case <-time.After(timeout):
-			debugPrint("ICMP Listener: Timeout while waiting for TCP Send")
-			done <- struct{}{}
+			p.debugPrint("ICMP Listener: Received TCP Channel Signal")
+		case <-stop:
+			p.debugPrint("ICMP Listener: Probing is over")
 			return
 		}
-		debugPrint("ICMP Listener: Trying to get next Packet")
+		p.debugPrint("ICMP Listener: Trying to get next Packet")
 		//toggle on layer type
-		waitForICMPorACK(packetSource, done)
+		r, err := p.waitForICMPorACK(sent)
+		if err != nil {
+			p.debugPrint("ICMP Listener: Capture closed")
+			done <- struct{}{}
+			return
+		}
 
 		select {
-		case tcpChan <- struct{}{}: // Signal TCP request send
-			debugPrint("ICMP Listener: Signaled TCP Channel")
+		case hopChan <- r: // Signal TCP request send
+			p.debugPrint("ICMP Listener: Signaled TCP Channel")
 		case <-time.After(timeout):
-			debugPrint("ICMP Listener: Timeout while signaling TCP Channel")
+			p.debugPrint("ICMP Listener: Timeout while signaling TCP Channel")
 			done <- struct{}{}
 			return
 		}
@@ -189,28 +349,68 @@ func setUpICMPListener(dev string, filter string, icmpChan chan struct{}, tcpCha
 
 }
 
-func waitForICMPorACK(packetSource *gopacket.PacketSource, done chan struct{}) {
+/*
+waitForICMPorACK returns the next reply to the probe in flight, an error only once the connection is closed.
+The capture sees the ICMP errors of every trace running, only those quoting the probe in flight are replies.
+Those quoting the sequence number of an earlier probe are late, the queries at a TTL share a source port.
+A middlebox rewriting the sequence number doesn't hide the routers behind it, what they quote is taken as long
+as it isn't that of an earlier probe.
+*/
+func (p *prober) waitForICMPorACK(sent map[uint16]tracebox.Probe) (reply, error) {
 	for {
-		packet, err := packetSource.NextPacket()
-		debugPrint(fmt.Sprintf("ICMP Listener: Received Packet %s", packet))
+		pkt, err := p.conn.Receive()
+		if errors.Is(err, net.ErrClosed) {
+			return reply{}, err
+		}
 		if err != nil {
-			debugPrint("Failed to get next packet:", err)
+			p.debugPrint("Failed to get next packet:", err)
+			continue
 		}
+		packet := gopacket.NewPacket(pkt.Data, layers.LayerTypeIPv4, gopacket.Default)
+		packet.Metadata().Timestamp = pkt.At
+		p.debugPrint(fmt.Sprintf("ICMP Listener: Received Packet %s", packet))
 
 		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			if isTCPAck(packet) {
+			if p.answers(packet) {
 				{
-					fmt.Println(" Got TCP ACK Packet from : ", packet.NetworkLayer().NetworkFlow().Src())
-					done <- struct{}{}
-					return
+					fmt.Fprintln(p.opts.Output(), " Got TCP ACK Packet from : ", packet.NetworkLayer().NetworkFlow().Src())
+					tcp, _ := tcpLayer.(*layers.TCP)
+					hop := p.packetHop(packet, uint16(tcp.DstPort))
+					p.record(packet, pcapng.ReplyComment(hop.TTL, fmt.Sprintf("sport=%d", tcp.DstPort)))
+					return reply{hop: hop, at: packet.Metadata().Timestamp, reached: true}, nil
 				}
 			}
-			debugPrint("ICMP Listener: Continue to wait for ICMP Packet")
+			if out, ok := p.outgoingProbe(packet); ok {
+				srcPort := binary.BigEndian.Uint16(out.Transport)
+				sent[srcPort] = out
+				p.record(packet, pcapng.ProbeComment(p.probeTTL(srcPort), fmt.Sprintf("sport=%d", srcPort)))
+			}
+			p.debugPrint("ICMP Listener: Continue to wait for ICMP Packet")
 
 		} else {
-			if src := getICMPInfo(packet); src != "" {
-				fmt.Println("  ICMP Packet Received from : ", src)
-				return
+			if src := p.getICMPInfo(packet); src != "" {
+				dst, srcPort, seq := quotedProbe(packet)
+				if !dst.Equal(p.target) || p.probeTTL(srcPort) == 0 {
+					p.debugPrint("ICMP Listener: IGNORE ICMP Packet not quoting one of our probes")
+					continue
+				}
+				if probe, late := p.inFlight(seq); p.probeTTL(srcPort) != probe.ttl || late {
+					p.debugPrint("ICMP Listener: IGNORE late ICMP Packet quoting an earlier probe")
+					continue
+				}
+				fmt.Fprintln(p.opts.Output(), "  ICMP Packet Received from : ", src)
+				hop := p.packetHop(packet, srcPort)
+				icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+				if out, ok := sent[srcPort]; ok {
+					out.Expired = icmpLayer.(*layers.ICMPv4).TypeCode.Type() == layers.ICMPv4TypeTimeExceeded
+					hop.CompareQuote(out, icmpLayer.LayerPayload())
+				}
+				p.record(packet, pcapng.ReplyComment(hop.TTL, fmt.Sprintf("sport=%d", srcPort)))
+				msg := append(append([]byte(nil), icmpLayer.LayerContents()...), icmpLayer.LayerPayload()...)
+				if err := hop.AddExtensions(msg); err != nil {
+					p.debugPrint("Failed to parse ICMP extensions: ", err)
+				}
+				return reply{hop: hop, at: packet.Metadata().Timestamp}, nil
 			}
 		}
 
@@ -218,48 +418,134 @@ func waitForICMPorACK(packetSource *gopacket.PacketSource, done chan struct{}) {
 
 }
 
-func isTCPAck(packet gopacket.Packet) bool {
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		//print syn ISN
-		debugPrint("SYN ISN: ", tcp.Seq)
-		//print ack ISN
-		debugPrint("ACK ISN: ", tcp.Ack)
+// packetHop builds the hop for a captured reply, srcPort is the source port of the probe it answers
+func (p *prober) packetHop(packet gopacket.Packet, srcPort uint16) trace.Hop {
+	hop := trace.Hop{}
+	if ip4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
+		hop.Addr = ip4.SrcIP
+		hop.ReplyTTL = int(ip4.TTL)
+	}
+	hop.TTL = p.probeTTL(srcPort)
+	return hop
+}
 
-		return tcp.ACK && tcp.SYN
+// probeTTL is the TTL of the probe sent from srcPort, 0 if it isn't one of ours
+func (p *prober) probeTTL(srcPort uint16) int {
+	if ttl := int(srcPort) - p.portBase; ttl > 0 && ttl <= 255 {
+		return ttl
 	}
-	return false
+	return 0
 }
-func getICMPInfo(packet gopacket.Packet) string {
+
+// quotedProbe extracts the destination, source port and sequence number of the TCP probe quoted in an ICMP error, nil if there is none
+func quotedProbe(packet gopacket.Packet) (net.IP, uint16, uint32) {
+	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		return nil, 0, 0
+	}
+	payload := icmpLayer.LayerPayload()
+	if len(payload) < 20 || layers.IPProtocol(payload[9]) != layers.IPProtocolTCP {
+		return nil, 0, 0
+	}
+	ipHeaderLength := int(payload[0]&0x0f) * 4
+	// routers quote at least the first 8 bytes of the segment, up to the sequence number
+	if len(payload) < ipHeaderLength+8 {
+		return nil, 0, 0
+	}
+	segment := payload[ipHeaderLength:]
+	return net.IP(payload[16:20]), binary.BigEndian.Uint16(segment), binary.BigEndian.Uint32(segment[4:])
+}
+
+// outgoingProbe returns one of our own SYN probes as captured on the way out
+func (p *prober) outgoingProbe(packet gopacket.Packet) (tracebox.Probe, bool) {
+	ip4, ok := packet.NetworkLayer().(*layers.IPv4)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || tcp == nil || !tcp.SYN || tcp.ACK {
+		return tracebox.Probe{}, false
+	}
+	if p.probeTTL(uint16(tcp.SrcPort)) == 0 {
+		return tracebox.Probe{}, false
+	}
+	return tracebox.FromPacket(append(append([]byte(nil), ip4.Contents...), ip4.Payload...))
+}
+
+// record writes the IP datagram of a captured packet to the capture file, if there is one
+func (p *prober) record(packet gopacket.Packet, comment string) {
+	ip4, ok := packet.NetworkLayer().(*layers.IPv4)
+	if p.opts.Capture == nil || !ok {
+		return
+	}
+	datagram := append(append([]byte(nil), ip4.Contents...), ip4.Payload...)
+	if err := p.opts.Capture.WritePacket(packet.Metadata().Timestamp, datagram, comment); err != nil {
+		fmt.Fprintln(p.opts.Output(), "Failed to write capture: ", err)
+	}
+}
+
+// annotateHop looks up the ASN of the responding hop and prints it
+func (p *prober) annotateHop(hop *trace.Hop) {
+	if err := hop.Annotate(p.opts.ASN); err != nil {
+		fmt.Fprintln(p.opts.Output(), "Failed to find ASN: ", err)
+	}
+	hop.InferReturnPath()
+	out := p.opts.Output()
+	hop.PrintASN(out)
+	hop.PrintReturnPath(out)
+	hop.PrintExtensions(out)
+	hop.PrintMarking(out)
+	hop.PrintModifications(out)
+}
+
+/*
+answers reports whether packet is the SYN-ACK or RST of the target to the probe in flight, a closed port still
+ends the trace.
+The capture takes in every connection using the ports of the trace, and the kernel answers SYN-ACKs to our raw
+SYNs with a RST of its own, so the source, both ports and the acknowledged sequence number must match.
+*/
+func (p *prober) answers(packet gopacket.Packet) bool {
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	ip4, _ := packet.NetworkLayer().(*layers.IPv4)
+	if tcp == nil || ip4 == nil || !(tcp.SYN && tcp.ACK || tcp.RST) {
+		return false
+	}
+	//print syn ISN
+	p.debugPrint("SYN ISN: ", tcp.Seq)
+	//print ack ISN
+	p.debugPrint("ACK ISN: ", tcp.Ack)
+
+	probe, _ := p.inFlight(0)
+	return ip4.SrcIP.Equal(p.target) && tcp.SrcPort == layers.TCPPort(p.port) &&
+		int(tcp.DstPort) == p.portBase+probe.ttl && tcp.Ack == probe.seq+1
+}
+
+func (p *prober) getICMPInfo(packet gopacket.Packet) string {
 	// Let's see if the packet is an ICMP packet
 	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
 	if icmpLayer != nil {
-		debugPrint("ICMP packet detected")
+		p.debugPrint("ICMP packet detected")
 
 		icmp, _ := icmpLayer.(*layers.ICMPv4)
 
 		src := packet.NetworkLayer().NetworkFlow().Src()
 
-		debugPrint(fmt.Sprintf("From %v to %v\n",
+		p.debugPrint(fmt.Sprintf("From %v to %v\n",
 			src,
 			packet.NetworkLayer().NetworkFlow().Dst()))
 
-		debugPrint("ICMP Type: ", icmp.TypeCode.Type())
-		debugPrint("ICMP Code: ", icmp.TypeCode.Code())
+		p.debugPrint("ICMP Type: ", icmp.TypeCode.Type())
+		p.debugPrint("ICMP Code: ", icmp.TypeCode.Code())
 
 		// Print more details based on ICMP type
 		switch icmp.TypeCode.Type() {
 		case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
-			debugPrint("ICMP ID: ", icmp.Id)
-			debugPrint("ICMP Sequence: ", icmp.Seq)
+			p.debugPrint("ICMP ID: ", icmp.Id)
+			p.debugPrint("ICMP Sequence: ", icmp.Seq)
 		case layers.ICMPv4TypeDestinationUnreachable:
-			debugPrint("Destination Unreachable")
+			p.debugPrint("Destination Unreachable")
 		case layers.ICMPv4TypeTimeExceeded:
-			debugPrint("Time Exceeded")
+			p.debugPrint("Time Exceeded")
 		}
 
-		debugPrint("--- End of ICMP Packet ---")
+		p.debugPrint("--- End of ICMP Packet ---")
 		return fmt.Sprintf("%v", src)
 	}
 	return ""
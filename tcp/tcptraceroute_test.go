@@ -0,0 +1,217 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/netsim"
+	"github.com/monmohan/traceroute/trace"
+)
+
+var (
+	local  = net.IPv4(192, 168, 1, 10).To4()
+	target = net.IPv4(93, 184, 216, 34).To4()
+)
+
+func TestTraceConn(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 200 * time.Millisecond
+
+	routers := []netsim.Router{
+		{Addr: net.IPv4(192, 168, 1, 1), Latency: time.Millisecond},
+		{Addr: net.IPv4(10, 0, 0, 1), Silent: true},
+		{Addr: net.IPv4(10, 0, 1, 1), Latency: 5 * time.Millisecond},
+	}
+	tests := []struct {
+		name string
+		port int
+	}{
+		{"open port answers with SYN-ACK", 443},
+		{"closed port answers with RST", 8080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &netsim.Network{
+				Local:   local,
+				Routers: routers,
+				Target:  netsim.Host{Addr: target, Latency: 8 * time.Millisecond, OpenPorts: []int{443}},
+			}
+			conn := n.CaptureConn(layers.IPProtocolTCP)
+			defer conn.Close()
+
+			result := traceConn(conn, 0, &net.IPAddr{IP: target}, tt.port, trace.Options{MaxHops: 10, Queries: 1})
+			if !result.Reached {
+				t.Fatal("trace did not reach the target")
+			}
+			want := []struct {
+				addr    net.IP
+				latency time.Duration
+			}{
+				{routers[0].Addr, time.Millisecond},
+				{nil, 0},
+				{routers[2].Addr, 5 * time.Millisecond},
+				{target, 8 * time.Millisecond},
+			}
+			if len(result.Hops) != len(want) {
+				t.Fatalf("got %d hops, want %d", len(result.Hops), len(want))
+			}
+			for i, h := range result.Hops {
+				w := want[i]
+				if h.TTL != i+1 || !h.Addr.Equal(w.addr) || h.RTT < w.latency {
+					t.Errorf("hop %d: got: %d %v %v, want: %d %v >=%v", i, h.TTL, h.Addr, h.RTT, i+1, w.addr, w.latency)
+				}
+				if len(h.Modifications) != 0 {
+					t.Errorf("hop %d: unexpected modifications %v", i, h.Modifications)
+				}
+			}
+			if last := result.Hops[3]; !last.Destination || last.ReturnHops != 4 {
+				t.Errorf("got: destination %v %d hops back, want: destination true 4 hops back", last.Destination, last.ReturnHops)
+			}
+		})
+	}
+}
+
+func TestTraceOn(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 200 * time.Millisecond
+
+	n := &netsim.Network{
+		Local: local,
+		Routers: []netsim.Router{
+			{Addr: net.IPv4(192, 168, 1, 1), Latency: time.Millisecond},
+			{Addr: net.IPv4(10, 0, 1, 1), Latency: 3 * time.Millisecond},
+		},
+		Target: netsim.Host{Addr: target, Latency: 4 * time.Millisecond, OpenPorts: []int{443}},
+	}
+	mux := netio.NewMux(n.CaptureConn(layers.IPProtocolTCP), portBlocks, demux)
+	defer mux.Close()
+
+	// the traces probe the same port of the same target at the same time, only their source ports differ
+	results := make(chan *trace.Result, 3)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			result, err := TraceOn(mux, &net.IPAddr{IP: target}, 443, trace.Options{MaxHops: 10, Queries: 1})
+			if err != nil {
+				t.Errorf("failed to trace: %v", err)
+			}
+			results <- result
+		}()
+	}
+	for i := 0; i < cap(results); i++ {
+		result := <-results
+		if result == nil {
+			continue
+		}
+		if !result.Reached || len(result.Hops) != 3 {
+			t.Fatalf("got %d hops reached %v, want 3 hops reached", len(result.Hops), result.Reached)
+		}
+		for j, h := range result.Hops {
+			if h.Addr == nil || h.TTL != j+1 {
+				t.Errorf("hop %d: got: %v at TTL %d, its reply went to another trace", j, h.Addr, h.TTL)
+			}
+		}
+	}
+}
+
+func TestTraceConnLateReply(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 200 * time.Millisecond
+
+	// the reply to the first query comes in while the second one is in flight, from the same source port
+	n := &netsim.Network{
+		Local:   local,
+		Routers: []netsim.Router{{Addr: net.IPv4(192, 168, 1, 1), Latency: 300 * time.Millisecond}},
+		Target:  netsim.Host{Addr: target, OpenPorts: []int{443}},
+	}
+	conn := n.CaptureConn(layers.IPProtocolTCP)
+	defer conn.Close()
+
+	result := traceConn(conn, 0, &net.IPAddr{IP: target}, 443, trace.Options{MaxHops: 2, Queries: 2})
+	if len(result.Hops) != 2 {
+		t.Fatalf("got %d hops, want 2", len(result.Hops))
+	}
+	for i, h := range result.Hops {
+		if h.Addr != nil && h.RTT < 300*time.Millisecond {
+			t.Errorf("query %d: got: %v after %v, the reply to the query before", i, h.Addr, h.RTT)
+		}
+	}
+}
+
+func TestAnswers(t *testing.T) {
+	p := &prober{portBase: portBase(0), target: target, port: 443, current: syn{ttl: 3, seq: 1000}}
+	packet := func(src net.IP, sport, dport uint16, ack uint32, synFlag, rst bool) gopacket.Packet {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: local}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), Ack: ack, ACK: true, SYN: synFlag, RST: rst, Window: 65535}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, ip, tcp); err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+	sport := uint16(p.portBase + 3)
+
+	tests := []struct {
+		name   string
+		packet gopacket.Packet
+		want   bool
+	}{
+		{"SYN-ACK to the probe", packet(target, 443, sport, 1001, true, false), true},
+		{"RST to the probe", packet(target, 443, sport, 1001, false, true), true},
+		{"SYN-ACK from another host", packet(net.IPv4(10, 0, 0, 9).To4(), 443, sport, 1001, true, false), false},
+		{"SYN-ACK from another port", packet(target, 8443, sport, 1001, true, false), false},
+		{"SYN-ACK to another TTL", packet(target, 443, sport+1, 1001, true, false), false},
+		{"SYN-ACK to another query", packet(target, 443, sport, 2001, true, false), false},
+		{"RST of the kernel", packet(local, sport, 443, 1, false, true), false},
+		{"ACK of a connection", packet(target, 443, sport, 1001, false, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.answers(tt.packet); got != tt.want {
+				t.Errorf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDemux(t *testing.T) {
+	syn := func(sport, dport uint16, flags byte) []byte {
+		d := make([]byte, 40)
+		d[0], d[9] = 0x45, byte(layers.IPProtocolTCP)
+		binary.BigEndian.PutUint16(d[20:], sport)
+		binary.BigEndian.PutUint16(d[22:], dport)
+		d[33] = flags
+		return d
+	}
+	base := uint16(portBase(5))
+	quote := append([]byte{0x45, 0, 0, 0, 0, 0, 0, 0, 1, byte(layers.IPProtocolTCP)}, make([]byte, 10)...)
+	timeExceeded := append(append([]byte{0x45, 0, 0, 0, 0, 0, 0, 0, 0, byte(layers.IPProtocolICMPv4)}, make([]byte, 10)...), 11, 0, 0, 0, 0, 0, 0, 0)
+	timeExceeded = append(append(timeExceeded, quote...), byte((base+3)>>8), byte(base+3), 1, 187)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		key      int
+		ok       bool
+	}{
+		{"outgoing SYN", syn(base+7, 443, 0x02), 5, true},
+		{"SYN-ACK from the target", syn(443, base+7, 0x12), 5, true},
+		{"RST from the target", syn(443, base+7, 0x14), 5, true},
+		{"time exceeded quoting a SYN", timeExceeded, 5, true},
+		{"port below the range", syn(443, 1024, 0x12), 0, false},
+		{"truncated", []byte{0x45}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := demux(tt.datagram)
+			if key != tt.key || ok != tt.ok {
+				t.Errorf("got: %d %v, want: %d %v", key, ok, tt.key, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Kinds of Anomaly
+const (
+	// AnomalyLoop is a sequence of responders that keeps repeating, packets are going round in circles
+	AnomalyLoop = "loop"
+	// AnomalyCycle is a responder that shows up again after other hops, without the path repeating
+	AnomalyCycle = "cycle"
+	// AnomalyDiamond is a stretch of TTLs answered by several routers, between a common divergence and convergence point
+	AnomalyDiamond = "diamond"
+	// AnomalyEarlyDestination is the destination address answering for a probe that never reached it, e.g. NAT or a proxy
+	AnomalyEarlyDestination = "early-destination"
+)
+
+// loopRepeats is how many times a sequence must be seen in a row before the loop is considered confirmed
+const loopRepeats = 3
+
+// Anomaly is something odd about the shape of the path, found by an Analyzer.
+type Anomaly struct {
+	Kind  string   `json:"kind"`
+	TTLs  []int    `json:"ttls"`
+	Addrs []net.IP `json:"addrs"`
+}
+
+func (a Anomaly) String() string {
+	var ttls, addrs []string
+	for _, t := range a.TTLs {
+		ttls = append(ttls, fmt.Sprint(t))
+	}
+	for _, ip := range a.Addrs {
+		addrs = append(addrs, ip.String())
+	}
+	return fmt.Sprintf("%s at TTL %s: %s", a.Kind, strings.Join(ttls, ","), strings.Join(addrs, " "))
+}
+
+/*
+Analyzer looks at hops as they are collected. Add tells the prober when a loop is confirmed so it can stop
+instead of probing up to the maximum TTL, Anomalies reports everything found so far.
+*/
+type Analyzer struct {
+	target net.IP
+	hops   []Hop
+	// path is the first responder of each TTL, nil when the TTL has not answered
+	path []net.IP
+	loop *Anomaly
+}
+
+// NewAnalyzer returns an Analyzer for a trace towards target.
+func NewAnalyzer(target net.IP) *Analyzer {
+	return &Analyzer{target: target}
+}
+
+// Add records hop and reports whether the trace is now stuck in a confirmed loop.
+func (a *Analyzer) Add(hop Hop) bool {
+	a.hops = append(a.hops, hop)
+	if hop.TTL <= 0 {
+		return a.loop != nil
+	}
+	for len(a.path) < hop.TTL {
+		a.path = append(a.path, nil)
+	}
+	if a.path[hop.TTL-1] == nil && hop.Addr != nil {
+		a.path[hop.TTL-1] = hop.Addr
+	}
+	if a.loop == nil {
+		a.loop = findLoop(a.path)
+	}
+	return a.loop != nil
+}
+
+/*
+findLoop checks whether path ends with the same sequence of responders repeated loopRepeats times.
+Silent TTLs break the sequence, a loop has to be seen answering. A packet needs at least two routers to loop,
+the same router answering consecutive TTLs is usually zero-TTL forwarding and is left alone.
+*/
+func findLoop(path []net.IP) *Anomaly {
+	n := len(path)
+	for period := 2; period*loopRepeats <= n; period++ {
+		repeated := true
+		for k := 0; k < period*(loopRepeats-1) && repeated; k++ {
+			i := n - 1 - k
+			repeated = path[i] != nil && path[i].Equal(path[i-period])
+		}
+		if !repeated || !distinct(path[n-period:]) {
+			continue
+		}
+		first := n - period*loopRepeats
+		loop := &Anomaly{Kind: AnomalyLoop}
+		for i := first; i < n; i++ {
+			loop.TTLs = append(loop.TTLs, i+1)
+		}
+		loop.Addrs = append(loop.Addrs, path[first:first+period]...)
+		return loop
+	}
+	return nil
+}
+
+// distinct reports whether window holds at least two different addresses
+func distinct(window []net.IP) bool {
+	for _, ip := range window[1:] {
+		if !ip.Equal(window[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Anomalies returns what was found in the hops added so far, ordered by kind then TTL.
+func (a *Analyzer) Anomalies() []Anomaly {
+	var anomalies []Anomaly
+	if a.loop != nil {
+		anomalies = append(anomalies, *a.loop)
+	}
+	anomalies = append(anomalies, a.cycles()...)
+	anomalies = append(anomalies, a.diamonds()...)
+	anomalies = append(anomalies, a.earlyDestination()...)
+	return anomalies
+}
+
+// cycles finds responders seen again after other hops, except those already explained by the loop.
+func (a *Analyzer) cycles() []Anomaly {
+	var cycles []Anomaly
+	reported := make(map[string]bool)
+	if a.loop != nil {
+		for _, ip := range a.loop.Addrs {
+			reported[ip.String()] = true
+		}
+	}
+	for i, ip := range a.path {
+		if ip == nil || reported[ip.String()] || ip.Equal(a.target) {
+			continue
+		}
+		reported[ip.String()] = true
+		// the same router at consecutive TTLs is common and harmless, count each run once
+		cycle := Anomaly{Kind: AnomalyCycle, TTLs: []int{i + 1}, Addrs: []net.IP{ip}}
+		for j := i + 1; j < len(a.path); j++ {
+			if ip.Equal(a.path[j]) && !ip.Equal(a.path[j-1]) {
+				cycle.TTLs = append(cycle.TTLs, j+1)
+			}
+		}
+		if len(cycle.TTLs) > 1 {
+			cycles = append(cycles, cycle)
+		}
+	}
+	return cycles
+}
+
+// diamonds finds stretches of TTLs with several responders, usually load balancing.
+func (a *Analyzer) diamonds() []Anomaly {
+	byTTL := make(map[int][]net.IP)
+	var ttls []int
+	for _, h := range a.hops {
+		if h.Addr == nil || h.TTL <= 0 {
+			continue
+		}
+		seen := byTTL[h.TTL]
+		if len(seen) == 0 {
+			ttls = append(ttls, h.TTL)
+		}
+		known := false
+		for _, ip := range seen {
+			known = known || ip.Equal(h.Addr)
+		}
+		if !known {
+			byTTL[h.TTL] = append(seen, h.Addr)
+		}
+	}
+	sort.Ints(ttls)
+
+	var diamonds []Anomaly
+	var open *Anomaly
+	for _, ttl := range ttls {
+		responders := byTTL[ttl]
+		if len(responders) > 1 {
+			if open == nil {
+				open = &Anomaly{Kind: AnomalyDiamond}
+			}
+			open.TTLs = append(open.TTLs, ttl)
+			open.Addrs = append(open.Addrs, responders...)
+			continue
+		}
+		// a single responder again is the convergence point
+		if open != nil {
+			diamonds = append(diamonds, *open)
+			open = nil
+		}
+	}
+	if open != nil {
+		diamonds = append(diamonds, *open)
+	}
+	return diamonds
+}
+
+// earlyDestination finds the destination address answering for probes that expired on the way.
+func (a *Analyzer) earlyDestination() []Anomaly {
+	var early []Anomaly
+	for _, h := range a.hops {
+		if h.Addr.Equal(a.target) && !h.Destination {
+			early = append(early, Anomaly{Kind: AnomalyEarlyDestination, TTLs: []int{h.TTL}, Addrs: []net.IP{h.Addr}})
+		}
+	}
+	return early
+}
+
+// PrintAnomalies prints the anomalies found on the path, if any.
+func (r *Result) PrintAnomalies(w io.Writer) {
+	for _, a := range r.Anomalies {
+		fmt.Fprintln(w, "Anomaly: ", a)
+	}
+}
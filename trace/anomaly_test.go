@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// path builds one hop per TTL from the given addresses, "" is a TTL that did not answer
+func path(addrs ...string) []Hop {
+	var hops []Hop
+	for i, a := range addrs {
+		hops = append(hops, Hop{TTL: i + 1, Addr: net.ParseIP(a)})
+	}
+	return hops
+}
+
+func TestAnalyzerLoop(t *testing.T) {
+	tests := []struct {
+		name     string
+		hops     []Hop
+		wantStop int
+		wantTTLs []int
+	}{
+		{
+			name:     "two routers bouncing",
+			hops:     path("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.2", "10.0.0.3", "10.0.0.2", "10.0.0.3", "10.0.0.2"),
+			wantStop: 7,
+			wantTTLs: []int{2, 3, 4, 5, 6, 7},
+		},
+		{
+			name:     "three router loop",
+			hops:     path("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.2", "10.0.0.3", "10.0.0.4"),
+			wantStop: 10,
+			wantTTLs: []int{2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		{
+			name: "same router at consecutive ttls",
+			hops: path("10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.2", "10.0.0.3"),
+		},
+		{
+			name: "single router answering every ttl",
+			hops: path("10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1"),
+		},
+		{
+			name: "silent hop breaks the sequence",
+			hops: path("10.0.0.2", "10.0.0.3", "", "10.0.0.3", "10.0.0.2", "10.0.0.3"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAnalyzer(net.ParseIP("192.0.2.1"))
+			stop := 0
+			for _, h := range test.hops {
+				if a.Add(h) {
+					stop = h.TTL
+					break
+				}
+			}
+			if stop != test.wantStop {
+				t.Fatalf("stopped at: %d, want: %d", stop, test.wantStop)
+			}
+			if test.wantStop == 0 {
+				return
+			}
+			loop := a.Anomalies()[0]
+			if loop.Kind != AnomalyLoop || !reflect.DeepEqual(loop.TTLs, test.wantTTLs) {
+				t.Errorf("got: %v, want loop at TTLs %v", loop, test.wantTTLs)
+			}
+		})
+	}
+}
+
+func TestAnalyzerAnomalies(t *testing.T) {
+	target := net.ParseIP("192.0.2.1")
+	hops := path("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.2", "10.0.0.5", "", "10.0.0.9")
+	// a second query at TTLs 5 and 6 took another branch of a load balancer
+	hops = append(hops, Hop{TTL: 5, Addr: net.ParseIP("10.0.0.6")}, Hop{TTL: 6, Addr: net.ParseIP("10.0.0.7")}, Hop{TTL: 6, Addr: net.ParseIP("10.0.0.8")})
+	hops = append(hops, Hop{TTL: 8, Addr: target}, Hop{TTL: 9, Addr: target, Destination: true})
+
+	a := NewAnalyzer(target)
+	for _, h := range hops {
+		if a.Add(h) {
+			t.Fatalf("unexpected loop at TTL %d", h.TTL)
+		}
+	}
+	var got []string
+	for _, anomaly := range a.Anomalies() {
+		got = append(got, anomaly.String())
+	}
+	want := []string{
+		"cycle at TTL 2,4: 10.0.0.2",
+		"diamond at TTL 5,6: 10.0.0.5 10.0.0.6 10.0.0.7 10.0.0.8",
+		"early-destination at TTL 8: 192.0.2.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %q, want: %q", got, want)
+	}
+}
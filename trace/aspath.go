@@ -0,0 +1,148 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of ASSegment
+const (
+	SegmentAS         = "as"
+	SegmentPrivate    = "private"
+	SegmentUnresolved = "unresolved"
+	SegmentNoReply    = "no-reply"
+)
+
+// cgnat is the shared address space of RFC 6598, not covered by net.IP.IsPrivate
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+/*
+ASSegment is a run of consecutive TTLs inside one AS, or a gap on the AS path:
+hops that did not reply, used private addresses or could not be mapped to an AS.
+A gap between two runs of the same AS is considered part of that AS.
+AddedLatency is how much the RTT grew from the last responding hop before the segment
+to the last responding hop inside it, 0 when it shrank, e.g. because a router is slow to answer itself.
+*/
+type ASSegment struct {
+	Kind         string        `json:"kind"`
+	ASN          string        `json:"asn,omitempty"`
+	ASName       string        `json:"name,omitempty"`
+	CountryCode  string        `json:"country,omitempty"`
+	FirstTTL     int           `json:"first_ttl"`
+	LastTTL      int           `json:"last_ttl"`
+	Responding   int           `json:"responding_hops"`
+	AddedLatency time.Duration `json:"added_latency_ns"`
+	lastRTT      time.Duration
+}
+
+// ASPath collapses hops into AS segments ordered by TTL. When a TTL has several hops the first reply is used.
+func ASPath(hops []Hop) []ASSegment {
+	byTTL := make(map[int]Hop)
+	var ttls []int
+	for _, h := range hops {
+		prev, seen := byTTL[h.TTL]
+		if !seen {
+			ttls = append(ttls, h.TTL)
+		}
+		if !seen || (prev.Addr == nil && h.Addr != nil) {
+			byTTL[h.TTL] = h
+		}
+	}
+	sort.Ints(ttls)
+
+	var segments []ASSegment
+	for _, ttl := range ttls {
+		h := byTTL[ttl]
+		seg := classify(h)
+		if n := len(segments); n > 0 && segments[n-1].Kind == seg.Kind && segments[n-1].ASN == seg.ASN {
+			segments[n-1].extend(seg)
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	// Fold gaps enclosed by the same AS into it
+	for i := 1; i+1 < len(segments); {
+		prev, gap, next := segments[i-1], segments[i], segments[i+1]
+		if gap.Kind != SegmentAS && prev.Kind == SegmentAS && next.Kind == SegmentAS && prev.ASN == next.ASN {
+			prev.extend(gap)
+			prev.extend(next)
+			segments[i-1] = prev
+			segments = append(segments[:i], segments[i+2:]...)
+			continue
+		}
+		i++
+	}
+
+	var baseline time.Duration
+	for i := range segments {
+		if segments[i].Responding == 0 {
+			continue
+		}
+		if segments[i].lastRTT > baseline {
+			segments[i].AddedLatency = segments[i].lastRTT - baseline
+		}
+		baseline = segments[i].lastRTT
+	}
+	return segments
+}
+
+func classify(h Hop) ASSegment {
+	seg := ASSegment{FirstTTL: h.TTL, LastTTL: h.TTL}
+	switch {
+	case h.Addr == nil:
+		seg.Kind = SegmentNoReply
+		return seg
+	case isPrivate(h.Addr):
+		seg.Kind = SegmentPrivate
+	case h.ASN == nil || h.ASN.ASNNumber == "" || h.ASN.ASNNumber == "0":
+		seg.Kind = SegmentUnresolved
+	default:
+		seg.Kind = SegmentAS
+		seg.ASN, seg.ASName, seg.CountryCode = h.ASN.ASNNumber, h.ASN.ASName, h.ASN.CountryCode
+	}
+	seg.Responding = 1
+	seg.lastRTT = h.RTT
+	return seg
+}
+
+func (s *ASSegment) extend(next ASSegment) {
+	s.LastTTL = next.LastTTL
+	if next.Responding > 0 {
+		s.Responding += next.Responding
+		s.lastRTT = next.lastRTT
+	}
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || cgnat.Contains(ip)
+}
+
+// PrintASPath prints the AS level summary of the trace.
+func (r *Result) PrintASPath(w io.Writer) {
+	var path []string
+	for _, s := range r.ASPath {
+		if s.Kind == SegmentAS {
+			path = append(path, "AS"+s.ASN)
+		}
+	}
+	fmt.Fprintln(w, "AS path: ", strings.Join(path, " -> "))
+	for _, s := range r.ASPath {
+		ttls := fmt.Sprintf("TTL %d", s.FirstTTL)
+		if s.LastTTL != s.FirstTTL {
+			ttls = fmt.Sprintf("TTL %d-%d", s.FirstTTL, s.LastTTL)
+		}
+		switch s.Kind {
+		case SegmentAS:
+			fmt.Fprintf(w, "  %-10s AS%-8s %s %s  added %v\n", ttls, s.ASN, s.ASName, s.CountryCode, s.AddedLatency)
+		case SegmentNoReply:
+			fmt.Fprintf(w, "  %-10s *          no reply\n", ttls)
+		default:
+			fmt.Fprintf(w, "  %-10s *          %s  added %v\n", ttls, s.Kind, s.AddedLatency)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package trace
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/monmohan/traceroute/asn"
+)
+
+func hop(ttl int, addr string, rtt time.Duration, asNumber string) Hop {
+	h := Hop{TTL: ttl, RTT: rtt}
+	if addr != "" {
+		h.Addr = net.ParseIP(addr)
+	}
+	if asNumber != "" {
+		h.ASN = &asn.ASNData{ASNNumber: asNumber, ASName: "AS" + asNumber}
+	}
+	return h
+}
+
+func TestASPath(t *testing.T) {
+	ms := time.Millisecond
+	hops := []Hop{
+		hop(1, "192.168.18.1", 1*ms, ""),
+		hop(2, "116.88.128.1", 5*ms, "55430"),
+		hop(3, "183.90.44.189", 6*ms, "55430"),
+		hop(4, "", 0, ""),
+		hop(5, "183.90.44.190", 8*ms, "55430"),
+		hop(6, "203.118.6.233", 10*ms, "4657"),
+		hop(7, "10.0.0.1", 12*ms, ""),
+		hop(8, "", 0, ""),
+		hop(9, "99.83.65.110", 30*ms, "0"),
+		hop(10, "142.250.166.50", 40*ms, "15169"),
+		hop(10, "142.250.166.51", 41*ms, "15169"),
+		hop(11, "142.251.175.84", 42*ms, "15169"),
+	}
+
+	want := []ASSegment{
+		{Kind: SegmentPrivate, FirstTTL: 1, LastTTL: 1, Responding: 1, AddedLatency: 1 * ms},
+		{Kind: SegmentAS, ASN: "55430", FirstTTL: 2, LastTTL: 5, Responding: 3, AddedLatency: 7 * ms},
+		{Kind: SegmentAS, ASN: "4657", FirstTTL: 6, LastTTL: 6, Responding: 1, AddedLatency: 2 * ms},
+		{Kind: SegmentPrivate, FirstTTL: 7, LastTTL: 7, Responding: 1, AddedLatency: 2 * ms},
+		{Kind: SegmentNoReply, FirstTTL: 8, LastTTL: 8},
+		{Kind: SegmentUnresolved, FirstTTL: 9, LastTTL: 9, Responding: 1, AddedLatency: 18 * ms},
+		{Kind: SegmentAS, ASN: "15169", FirstTTL: 10, LastTTL: 11, Responding: 2, AddedLatency: 12 * ms},
+	}
+
+	got := ASPath(hops)
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Kind != w.Kind || g.ASN != w.ASN || g.FirstTTL != w.FirstTTL || g.LastTTL != w.LastTTL ||
+			g.Responding != w.Responding || g.AddedLatency != w.AddedLatency {
+			t.Errorf("segment %d: got: %+v, want: %+v", i, g, w)
+		}
+	}
+}
+
+func TestASPathEmpty(t *testing.T) {
+	if got := ASPath(nil); len(got) != 0 {
+		t.Errorf("got: %+v, want no segments", got)
+	}
+}
+
+func TestASPathFasterHop(t *testing.T) {
+	ms := time.Millisecond
+	// the router at TTL 2 rate limits its ICMP errors and answers slower than the next AS
+	got := ASPath([]Hop{
+		hop(1, "116.88.128.1", 5*ms, "55430"),
+		hop(2, "183.90.44.189", 20*ms, "55430"),
+		hop(3, "203.118.6.233", 9*ms, "4657"),
+		hop(4, "142.251.175.84", 15*ms, "15169"),
+	})
+	want := []time.Duration{20 * ms, 0, 6 * ms}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].AddedLatency != want[i] {
+			t.Errorf("segment %d: got: %v, want: %v", i, got[i].AddedLatency, want[i])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Package trace holds what the ICMP and TCP probers have in common: the hops they discover
+and how those hops are annotated and reported.
+*/
+package trace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/monmohan/traceroute/asn"
+	"github.com/monmohan/traceroute/icmpext"
+	"github.com/monmohan/traceroute/tracebox"
+)
+
+// Hop is the outcome of a single probe, the router (or destination) that answered at TTL.
+// Addr is nil when the probe timed out.
+type Hop struct {
+	TTL  int           `json:"ttl"`
+	Addr net.IP        `json:"addr,omitempty"`
+	RTT  time.Duration `json:"rtt_ns,omitempty"`
+	ASN  *asn.ASNData  `json:"asn,omitempty"`
+	// MPLS is the label stack reported in the ICMP extensions (RFC 4950), set when the hop is inside an LSP
+	MPLS []icmpext.MPLSLabel `json:"mpls,omitempty"`
+	// Interfaces are the RFC 5837 interface information objects, usually the incoming interface of the router
+	Interfaces []icmpext.InterfaceInfo `json:"interfaces,omitempty"`
+	// Destination is set when the reply came from the target itself (Echo Reply, SYN-ACK) rather than a router on the way
+	Destination bool `json:"destination,omitempty"`
+	// Modifications are the header fields of the probe that were rewritten before it reached this hop
+	Modifications []tracebox.Change `json:"modifications,omitempty"`
+	// Marking is set for probes sent with a DSCP or ECN value, telling whether it survived the way to this hop
+	Marking *Marking `json:"marking,omitempty"`
+	// ReplyTTL is the IP TTL the reply arrived with, the rest is inferred from it by InferReturnPath
+	ReplyTTL   int    `json:"reply_ttl,omitempty"`
+	InitialTTL int    `json:"initial_ttl,omitempty"`
+	ReturnHops int    `json:"return_hops,omitempty"`
+	Asymmetric bool   `json:"asymmetric,omitempty"`
+	OSGuess    string `json:"os_guess,omitempty"`
+}
+
+// Result is a complete trace towards Target.
+type Result struct {
+	Target  net.IP      `json:"target"`
+	Proto   string      `json:"proto"`
+	Hops    []Hop       `json:"hops"`
+	Reached bool        `json:"reached"`
+	ASPath  []ASSegment `json:"as_path"`
+	// Anomalies are loops, cycles, diamonds and other oddities of the path
+	Anomalies []Anomaly `json:"anomalies,omitempty"`
+}
+
+// Annotate resolves the hop address through query. A nil query leaves the hop unannotated.
+func (h *Hop) Annotate(query asn.Query) error {
+	if query == nil || h.Addr == nil {
+		return nil
+	}
+	data, err := query.FindASN(h.Addr.String())
+	if err != nil {
+		return err
+	}
+	h.ASN = &data
+	return nil
+}
+
+// PrintASN prints the ASN annotation of the hop, if any, in the format shared by all probers.
+func (h *Hop) PrintASN(w io.Writer) {
+	if h.ASN == nil {
+		return
+	}
+	fmt.Fprintln(w, "ASN: ", h.ASN.ASNNumber, " ", h.ASN.ASName, " ", h.ASN.CountryCode)
+	if h.ASN.City != "" || h.ASN.AccuracyRadius > 0 {
+		fmt.Fprintf(w, "Location:  %s (%.4f, %.4f) ±%dkm\n", h.ASN.City, h.ASN.Latitude, h.ASN.Longitude, h.ASN.AccuracyRadius)
+	}
+}
+
+// AddExtensions records the ICMP extensions of the reply to the probe, msg is the ICMP message including its header.
+func (h *Hop) AddExtensions(msg []byte) error {
+	exts, err := icmpext.ParseMessage(msg)
+	if exts != nil {
+		h.MPLS = exts.MPLS
+		h.Interfaces = exts.Interfaces
+	}
+	return err
+}
+
+// PrintExtensions prints what was learnt from the ICMP extensions of the reply, if anything.
+func (h *Hop) PrintExtensions(w io.Writer) {
+	for _, i := range h.Interfaces {
+		fmt.Fprintln(w, "Interface: ", i)
+	}
+	for _, l := range h.MPLS {
+		fmt.Fprintln(w, "MPLS: ", l)
+	}
+}
+
+// CompareQuote records how the probe quoted in the ICMP error differs from what was sent.
+func (h *Hop) CompareQuote(sent tracebox.Probe, quoted []byte) {
+	h.Modifications = tracebox.Compare(sent, quoted)
+	h.Marking = markingOf(sent, quoted)
+}
+
+// PrintModifications prints the header fields rewritten on the way to the hop, if any.
+func (h *Hop) PrintModifications(w io.Writer) {
+	for _, c := range h.Modifications {
+		// the marking line already tells what became of them
+		if h.Marking != nil && (c.Field == "DSCP" || c.Field == "ECN") {
+			continue
+		}
+		fmt.Fprintln(w, "Modified: ", c)
+	}
+}
+
+// PrintHops prints the hop table of the trace with what is known about each hop.
+func (r *Result) PrintHops(w io.Writer) {
+	for _, h := range r.Hops {
+		if h.Addr == nil {
+			fmt.Fprintf(w, "%3d  *\n", h.TTL)
+			continue
+		}
+		fmt.Fprintf(w, "%3d  %-15s  %v\n", h.TTL, h.Addr, h.RTT)
+		h.PrintASN(w)
+		h.PrintReturnPath(w)
+		h.PrintExtensions(w)
+		h.PrintMarking(w)
+		h.PrintModifications(w)
+	}
+}
@@ -0,0 +1,68 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/monmohan/traceroute/tracebox"
+)
+
+/*
+Marking is what became of the DSCP and ECN bits of a marked probe by the time it reached the hop, as read
+from the header quoted in the ICMP error. QoS policies often bleach or remark DSCP at domain borders, and
+congested routers may set ECN to CE.
+*/
+type Marking struct {
+	SentDSCP uint8 `json:"sent_dscp"`
+	SentECN  uint8 `json:"sent_ecn"`
+	DSCP     uint8 `json:"dscp"`
+	ECN      uint8 `json:"ecn"`
+}
+
+// dscpNames are the code points of RFC 2474, 2597, 3246 and 5865
+var dscpNames = map[uint8]string{
+	0: "CS0", 8: "CS1", 16: "CS2", 24: "CS3", 32: "CS4", 40: "CS5", 48: "CS6", 56: "CS7",
+	10: "AF11", 12: "AF12", 14: "AF13", 18: "AF21", 20: "AF22", 22: "AF23",
+	26: "AF31", 28: "AF32", 30: "AF33", 34: "AF41", 36: "AF42", 38: "AF43",
+	44: "VOICE-ADMIT", 46: "EF",
+}
+
+var ecnNames = [4]string{"Not-ECT", "ECT(1)", "ECT(0)", "CE"}
+
+// Survived reports whether both DSCP and ECN arrived as they were sent
+func (m Marking) Survived() bool {
+	return m.SentDSCP == m.DSCP && m.SentECN == m.ECN
+}
+
+func (m Marking) String() string {
+	return fmt.Sprintf("DSCP %s, ECN %s", survival(dscpName(m.SentDSCP), dscpName(m.DSCP)), survival(ecnNames[m.SentECN&3], ecnNames[m.ECN&3]))
+}
+
+func dscpName(dscp uint8) string {
+	if name, ok := dscpNames[dscp]; ok {
+		return fmt.Sprintf("%s (%d)", name, dscp)
+	}
+	return fmt.Sprint(dscp)
+}
+
+func survival(sent, got string) string {
+	if sent == got {
+		return sent + " survived"
+	}
+	return sent + " rewritten to " + got
+}
+
+// markingOf compares the TOS of the probe with the one quoted back, nil when the probe wasn't marked
+func markingOf(sent tracebox.Probe, quoted []byte) *Marking {
+	if sent.TOS == 0 || len(quoted) < 2 || quoted[0]>>4 != 4 {
+		return nil
+	}
+	return &Marking{SentDSCP: sent.TOS >> 2, SentECN: sent.TOS & 3, DSCP: quoted[1] >> 2, ECN: quoted[1] & 3}
+}
+
+// PrintMarking prints whether the DSCP and ECN bits of a marked probe survived the way to the hop.
+func (h *Hop) PrintMarking(w io.Writer) {
+	if h.Marking != nil {
+		fmt.Fprintln(w, "Marking: ", h.Marking)
+	}
+}
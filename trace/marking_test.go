@@ -0,0 +1,44 @@
+package trace
+
+import (
+	"testing"
+
+	"github.com/monmohan/traceroute/tracebox"
+)
+
+func TestMarking(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     uint8
+		quoted   uint8
+		want     string
+		survived bool
+	}{
+		{"EF kept", 0xb8, 0xb8, "DSCP EF (46) survived, ECN Not-ECT survived", true},
+		{"EF bleached", 0xb8, 0x00, "DSCP EF (46) rewritten to CS0 (0), ECN Not-ECT survived", false},
+		{"congestion experienced", 0x8a, 0x8b, "DSCP AF41 (34) survived, ECN ECT(0) rewritten to CE", false},
+		{"unnamed code point", 0x04, 0x00, "DSCP 1 rewritten to CS0 (0), ECN Not-ECT survived", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a quoted IPv4 header, only its first two bytes matter
+			quoted := []byte{0x45, tt.quoted, 0, 28}
+			var h Hop
+			h.CompareQuote(tracebox.Probe{TOS: tt.sent}, quoted)
+			if h.Marking == nil {
+				t.Fatal("no marking for a marked probe")
+			}
+			if got := h.Marking.String(); got != tt.want {
+				t.Errorf("got: %v, want: %v", got, tt.want)
+			}
+			if h.Marking.Survived() != tt.survived {
+				t.Errorf("got: %v, want: %v", h.Marking.Survived(), tt.survived)
+			}
+		})
+	}
+
+	var h Hop
+	if h.CompareQuote(tracebox.Probe{}, []byte{0x45, 0xb8}); h.Marking != nil {
+		t.Errorf("got: %v, want: no marking for an unmarked probe", h.Marking)
+	}
+}
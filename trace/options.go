@@ -0,0 +1,43 @@
+package trace
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/monmohan/traceroute/asn"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/pcapng"
+)
+
+/*
+Options are the settings of one trace, for either prober. Everything a trace needs is in here rather than in
+package state, so any number of traces can run at once. ASN, Capture and Pacer may be shared between them.
+*/
+type Options struct {
+	Verbose bool
+	MaxHops int
+	// Queries is the number of probes sent per TTL
+	Queries int
+	// Src is the address the probes leave from
+	Src    net.IP
+	Socket netio.SocketOptions
+	// ASN annotates the hops, nil skips the lookups
+	ASN asn.Query
+	// Capture gets every probe and matched reply when it is not nil
+	Capture *pcapng.Writer
+	// Pacer spaces out the probes when it is not nil
+	Pacer *netio.Pacer
+	// OnHop is called with every hop as soon as it is known, when it is not nil
+	OnHop func(Hop)
+	// Out is where the progress of the trace is printed, stdout when nil
+	Out io.Writer
+}
+
+// Output returns Out, or os.Stdout when it isn't set
+func (o Options) Output() io.Writer {
+	if o.Out == nil {
+		return os.Stdout
+	}
+	return o.Out
+}
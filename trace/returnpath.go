@@ -0,0 +1,56 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+)
+
+// Initial TTLs used by common IP stacks
+var initialTTLs = []int{64, 128, 255}
+
+// osFamilies are best-effort guesses at the stack behind each initial TTL
+var osFamilies = map[int]string{
+	64:  "Linux/BSD/Unix-like",
+	128: "Windows",
+	255: "Network OS (Cisco, Juniper, ...)",
+}
+
+// InitialTTL infers the TTL the reply was sent with: the smallest common initial TTL not below the one received.
+func InitialTTL(replyTTL int) int {
+	for _, initial := range initialTTLs {
+		if replyTTL <= initial {
+			return initial
+		}
+	}
+	return 0
+}
+
+/*
+InferReturnPath derives the length of the path the reply took back from ReplyTTL.
+A router answering at TTL n is n hops away on the forward path, so the reply of a
+router on a symmetric path arrives having lost n-1 from its initial TTL.
+*/
+func (h *Hop) InferReturnPath() {
+	if h.ReplyTTL <= 0 {
+		return
+	}
+	h.InitialTTL = InitialTTL(h.ReplyTTL)
+	if h.InitialTTL == 0 {
+		return
+	}
+	h.ReturnHops = h.InitialTTL - h.ReplyTTL + 1
+	h.Asymmetric = h.TTL > 0 && h.ReturnHops > h.TTL
+	h.OSGuess = osFamilies[h.InitialTTL]
+}
+
+// PrintReturnPath prints what the reply TTL tells about the hop, if it was recorded.
+func (h *Hop) PrintReturnPath(w io.Writer) {
+	if h.InitialTTL == 0 {
+		return
+	}
+	longer := ""
+	if h.Asymmetric {
+		longer = ", longer than forward path"
+	}
+	fmt.Fprintf(w, "Reply TTL:  %d (initial %d, %d hops back%s) OS guess: %s\n", h.ReplyTTL, h.InitialTTL, h.ReturnHops, longer, h.OSGuess)
+}
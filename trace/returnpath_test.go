@@ -0,0 +1,52 @@
+package trace
+
+import "testing"
+
+func TestInitialTTL(t *testing.T) {
+	tests := []struct {
+		replyTTL int
+		want     int
+	}{
+		{1, 64},
+		{52, 64},
+		{64, 64},
+		{65, 128},
+		{117, 128},
+		{128, 128},
+		{129, 255},
+		{243, 255},
+		{255, 255},
+		{300, 0},
+	}
+	for _, test := range tests {
+		if got := InitialTTL(test.replyTTL); got != test.want {
+			t.Errorf("InitialTTL(%d) got: %d, want: %d", test.replyTTL, got, test.want)
+		}
+	}
+}
+
+func TestInferReturnPath(t *testing.T) {
+	tests := []struct {
+		name           string
+		hop            Hop
+		wantReturnHops int
+		wantAsymmetric bool
+		wantOS         string
+	}{
+		{name: "first hop linux", hop: Hop{TTL: 1, ReplyTTL: 64}, wantReturnHops: 1, wantOS: "Linux/BSD/Unix-like"},
+		{name: "symmetric router", hop: Hop{TTL: 5, ReplyTTL: 251}, wantReturnHops: 5, wantOS: "Network OS (Cisco, Juniper, ...)"},
+		{name: "longer way back", hop: Hop{TTL: 5, ReplyTTL: 245}, wantReturnHops: 11, wantAsymmetric: true, wantOS: "Network OS (Cisco, Juniper, ...)"},
+		{name: "shorter way back", hop: Hop{TTL: 9, ReplyTTL: 122}, wantReturnHops: 7, wantOS: "Windows"},
+		{name: "no reply ttl", hop: Hop{TTL: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := test.hop
+			h.InferReturnPath()
+			if h.ReturnHops != test.wantReturnHops || h.Asymmetric != test.wantAsymmetric || h.OSGuess != test.wantOS {
+				t.Errorf("got: %d hops, asymmetric %v, %q, want: %d hops, asymmetric %v, %q",
+					h.ReturnHops, h.Asymmetric, h.OSGuess, test.wantReturnHops, test.wantAsymmetric, test.wantOS)
+			}
+		})
+	}
+}
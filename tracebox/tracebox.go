@@ -0,0 +1,256 @@
+/*
+Package tracebox detects middleboxes that rewrite packets in flight, in the spirit of tracebox.
+
+ICMP errors quote the offending datagram as it arrived at the router: its IP header and at least
+the first 8 bytes of the transport header, often much more (RFC 1812). Comparing the quote with what
+was actually sent shows which fields were changed on the way, e.g. NAT rewriting addresses and ports,
+MSS clamping, or DSCP bleaching.
+*/
+package tracebox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IP protocol numbers of the probes that can be compared
+const (
+	protoICMP = 1
+	protoTCP  = 6
+)
+
+const tcpOptionMSS = 2
+
+// Probe is the datagram that was sent, as far as it is known.
+type Probe struct {
+	Src, Dst net.IP
+	TOS      uint8
+	// IPID is only compared when HasIPID is set, the kernel usually picks it
+	IPID     uint16
+	HasIPID  bool
+	Protocol uint8
+	// Transport is the transport header (and payload) as sent
+	Transport []byte
+	// Expired is set when the quote is from a Time Exceeded error, the probe then arrived with TTL 1. Other
+	// errors quote whatever TTL was left, which isn't known, so it is only compared for expired probes.
+	Expired bool
+}
+
+/*
+FromPacket builds a Probe from a captured copy of the datagram we sent, IP header included. An IP ID of 0 is
+taken as unknown: probes rebuilt after sending them through a raw socket, as the ICMP prober writes them to its
+capture, carry 0 while the kernel picked the real one.
+*/
+func FromPacket(datagram []byte) (Probe, bool) {
+	if len(datagram) < 20 || datagram[0]>>4 != 4 {
+		return Probe{}, false
+	}
+	ihl := int(datagram[0]&0x0f) * 4
+	if ihl < 20 || len(datagram) < ihl {
+		return Probe{}, false
+	}
+	return Probe{
+		Src:       net.IP(append([]byte(nil), datagram[12:16]...)),
+		Dst:       net.IP(append([]byte(nil), datagram[16:20]...)),
+		TOS:       datagram[1],
+		IPID:      binary.BigEndian.Uint16(datagram[4:6]),
+		HasIPID:   binary.BigEndian.Uint16(datagram[4:6]) != 0,
+		Protocol:  datagram[9],
+		Transport: append([]byte(nil), datagram[ihl:]...),
+	}, true
+}
+
+// Change is a header field that differs between what was sent and what the router quoted.
+type Change struct {
+	Field    string `json:"field"`
+	Sent     string `json:"sent"`
+	Received string `json:"received"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s -> %s", c.Field, c.Sent, c.Received)
+}
+
+/*
+Compare returns the fields of the quoted datagram, as found in the body of an ICMP error, that differ from probe.
+Only the bytes the router actually quoted are compared.
+*/
+func Compare(probe Probe, quoted []byte) []Change {
+	if len(quoted) < 20 || quoted[0]>>4 != 4 {
+		return nil
+	}
+	ihl := int(quoted[0]&0x0f) * 4
+	if ihl < 20 || len(quoted) < ihl {
+		return nil
+	}
+	var changes []Change
+	add := func(field string, sent, received interface{}) {
+		changes = append(changes, Change{Field: field, Sent: fmt.Sprint(sent), Received: fmt.Sprint(received)})
+	}
+
+	tos := quoted[1]
+	if sent, got := probe.TOS>>2, tos>>2; sent != got {
+		add("DSCP", sent, got)
+	}
+	if sent, got := probe.TOS&0x3, tos&0x3; sent != got {
+		add("ECN", sent, got)
+	}
+	if id := binary.BigEndian.Uint16(quoted[4:6]); probe.HasIPID && id != probe.IPID {
+		add("IP ID", probe.IPID, id)
+	}
+	// The probe expires on arrival with TTL 1, some routers quote it after decrementing to 0
+	if ttl := quoted[8]; probe.Expired && ttl > 1 {
+		add("TTL", 1, ttl)
+	}
+	if src := net.IP(quoted[12:16]); probe.Src != nil && !src.Equal(probe.Src) {
+		add("Source address", probe.Src, src)
+	}
+	if dst := net.IP(quoted[16:20]); probe.Dst != nil && !dst.Equal(probe.Dst) {
+		add("Destination address", probe.Dst, dst)
+	}
+
+	// Limit the quote to the original datagram, routers may pad it and append extensions
+	transport := quoted[ihl:]
+	if total := int(binary.BigEndian.Uint16(quoted[2:4])); total >= ihl && total-ihl < len(transport) {
+		transport = transport[:total-ihl]
+	}
+	if quoted[9] != probe.Protocol {
+		add("Protocol", probe.Protocol, quoted[9])
+		return changes
+	}
+	switch probe.Protocol {
+	case protoTCP:
+		changes = append(changes, compareTCP(probe.Transport, transport)...)
+	case protoICMP:
+		changes = append(changes, compareICMP(probe.Transport, transport)...)
+	}
+	return changes
+}
+
+func compareTCP(sent, quoted []byte) []Change {
+	var changes []Change
+	add := func(field string, sent, received interface{}) {
+		changes = append(changes, Change{Field: field, Sent: fmt.Sprint(sent), Received: fmt.Sprint(received)})
+	}
+	field16 := func(b []byte, off int) uint16 { return binary.BigEndian.Uint16(b[off:]) }
+	has := func(n int) bool { return len(sent) >= n && len(quoted) >= n }
+
+	if has(2) && field16(sent, 0) != field16(quoted, 0) {
+		add("Source port", field16(sent, 0), field16(quoted, 0))
+	}
+	if has(4) && field16(sent, 2) != field16(quoted, 2) {
+		add("Destination port", field16(sent, 2), field16(quoted, 2))
+	}
+	if has(8) && binary.BigEndian.Uint32(sent[4:]) != binary.BigEndian.Uint32(quoted[4:]) {
+		add("Sequence number", binary.BigEndian.Uint32(sent[4:]), binary.BigEndian.Uint32(quoted[4:]))
+	}
+	if has(14) && sent[13] != quoted[13] {
+		add("TCP flags", fmt.Sprintf("%#02x", sent[13]), fmt.Sprintf("%#02x", quoted[13]))
+	}
+	if has(16) && field16(sent, 14) != field16(quoted, 14) {
+		add("Window", field16(sent, 14), field16(quoted, 14))
+	}
+	if has(18) && field16(sent, 16) != field16(quoted, 16) {
+		add("TCP checksum", fmt.Sprintf("%#04x", field16(sent, 16)), fmt.Sprintf("%#04x", field16(quoted, 16)))
+	}
+	if !has(20) {
+		return changes
+	}
+
+	sentOpts, quotedOpts := tcpOptions(sent), tcpOptions(quoted)
+	sentLen, quotedLen := int(sent[12]>>4)*4, int(quoted[12]>>4)*4
+	if len(quoted) < quotedLen {
+		// Options were only partly quoted, nothing reliable to compare
+		return changes
+	}
+	sentMSS, sentHasMSS := mss(sentOpts)
+	quotedMSS, quotedHasMSS := mss(quotedOpts)
+	switch {
+	case sentHasMSS && quotedHasMSS && sentMSS != quotedMSS:
+		add("MSS", sentMSS, quotedMSS)
+	case sentHasMSS != quotedHasMSS:
+		add("MSS option", present(sentHasMSS), present(quotedHasMSS))
+	}
+	if sentLen != quotedLen || string(withoutMSS(sentOpts)) != string(withoutMSS(quotedOpts)) {
+		add("TCP options", fmt.Sprintf("%x", sentOpts), fmt.Sprintf("%x", quotedOpts))
+	}
+	return changes
+}
+
+func compareICMP(sent, quoted []byte) []Change {
+	var changes []Change
+	names := []string{"ICMP type/code", "ICMP checksum", "ICMP ID", "ICMP sequence"}
+	for i, name := range names {
+		off := i * 2
+		if len(sent) < off+2 || len(quoted) < off+2 {
+			break
+		}
+		if s, q := binary.BigEndian.Uint16(sent[off:]), binary.BigEndian.Uint16(quoted[off:]); s != q {
+			changes = append(changes, Change{Field: name, Sent: fmt.Sprintf("%#04x", s), Received: fmt.Sprintf("%#04x", q)})
+		}
+	}
+	return changes
+}
+
+// tcpOptions returns the options of a TCP header, or nil if they are not all there.
+func tcpOptions(header []byte) []byte {
+	if len(header) < 20 {
+		return nil
+	}
+	dataOffset := int(header[12]>>4) * 4
+	if dataOffset <= 20 || len(header) < dataOffset {
+		return nil
+	}
+	return header[20:dataOffset]
+}
+
+// mss finds the maximum segment size option.
+func mss(opts []byte) (uint16, bool) {
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0:
+			return 0, false
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 {
+			return 0, false
+		}
+		if opts[i] == tcpOptionMSS && opts[i+1] == 4 && i+4 <= len(opts) {
+			return binary.BigEndian.Uint16(opts[i+2:]), true
+		}
+		i += int(opts[i+1])
+	}
+	return 0, false
+}
+
+// withoutMSS blanks the MSS value so other option changes can be told apart from MSS clamping.
+func withoutMSS(opts []byte) []byte {
+	out := append([]byte(nil), opts...)
+	for i := 0; i < len(out); {
+		if out[i] == 0 {
+			break
+		}
+		if out[i] == 1 {
+			i++
+			continue
+		}
+		if i+1 >= len(out) || out[i+1] < 2 {
+			break
+		}
+		if out[i] == tcpOptionMSS && out[i+1] == 4 && i+4 <= len(out) {
+			out[i+2], out[i+3] = 0, 0
+		}
+		i += int(out[i+1])
+	}
+	return out
+}
+
+func present(b bool) string {
+	if b {
+		return "present"
+	}
+	return "absent"
+}
@@ -0,0 +1,191 @@
+package tracebox
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// datagram serializes an IPv4 SYN with an MSS option, modify can rewrite the headers first
+func datagram(t *testing.T, modify func(ip *layers.IPv4, tcp *layers.TCP)) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      1,
+		Id:       4321,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(192, 168, 1, 10),
+		DstIP:    net.IPv4(93, 184, 216, 34),
+	}
+	tcp := &layers.TCP{
+		SrcPort: 43592,
+		DstPort: 443,
+		Seq:     1000,
+		SYN:     true,
+		Window:  65535,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		},
+	}
+	if modify != nil {
+		modify(ip, tcp)
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func fields(changes []Change) []string {
+	var names []string
+	for _, c := range changes {
+		names = append(names, c.Field)
+	}
+	return names
+}
+
+func TestCompareTCP(t *testing.T) {
+	probe, ok := FromPacket(datagram(t, nil))
+	if !ok {
+		t.Fatal("failed to build probe from own packet")
+	}
+	probe.Expired = true
+
+	tests := []struct {
+		name   string
+		modify func(ip *layers.IPv4, tcp *layers.TCP)
+		// truncate limits the quote to the IP header plus that many transport bytes, 0 quotes everything
+		truncate int
+		want     []string
+	}{
+		{name: "unchanged"},
+		{name: "ttl decremented to zero", modify: func(ip *layers.IPv4, tcp *layers.TCP) { ip.TTL = 0 }},
+		{
+			name:   "ttl raised",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) { ip.TTL = 64 },
+			want:   []string{"TTL"},
+		},
+		{
+			name:   "ecn set",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) { ip.TOS = 0x01 },
+			want:   []string{"ECN"},
+		},
+		{
+			name: "nat",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) {
+				ip.SrcIP = net.IPv4(203, 0, 113, 7)
+				ip.Id = 1
+				tcp.SrcPort = 61000
+			},
+			want: []string{"IP ID", "Source address", "Source port", "TCP checksum"},
+		},
+		{
+			name: "mss clamped",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Options[0].OptionData = []byte{0x05, 0x64}
+			},
+			want: []string{"TCP checksum", "MSS"},
+		},
+		{
+			name: "options stripped",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Options = tcp.Options[:1]
+			},
+			want: []string{"TCP checksum", "TCP options"},
+		},
+		{
+			name: "window and seq rewritten",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Window = 1024
+				tcp.Seq = 77
+			},
+			want: []string{"Sequence number", "Window", "TCP checksum"},
+		},
+		{
+			name: "rfc 792 quote hides later fields",
+			modify: func(ip *layers.IPv4, tcp *layers.TCP) {
+				tcp.Window = 1024
+				tcp.Options[0].OptionData = []byte{0x05, 0x64}
+			},
+			truncate: 8,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			quoted := datagram(t, test.modify)
+			if test.truncate > 0 {
+				quoted = quoted[:20+test.truncate]
+			}
+			got := fields(Compare(probe, quoted))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got: %v, want: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFromPacketUnknownID(t *testing.T) {
+	// a probe rebuilt after sending it, the kernel picked the ID
+	probe, _ := FromPacket(datagram(t, func(ip *layers.IPv4, tcp *layers.TCP) { ip.Id = 0 }))
+	if probe.HasIPID {
+		t.Error("an IP ID of 0 should be unknown")
+	}
+	if changes := Compare(probe, datagram(t, nil)); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
+
+func TestCompareUnreachableTTL(t *testing.T) {
+	// a Destination Unreachable quotes the probe with the TTL it had left
+	probe, _ := FromPacket(datagram(t, nil))
+	quoted := datagram(t, func(ip *layers.IPv4, tcp *layers.TCP) { ip.TTL = 52 })
+	if changes := Compare(probe, quoted); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
+
+func TestCompareIgnoresPadding(t *testing.T) {
+	probe, _ := FromPacket(datagram(t, nil))
+	// RFC 4884 pads the quote to 128 bytes before the extensions
+	quoted := append(datagram(t, nil), make([]byte, 64)...)
+	if changes := Compare(probe, quoted); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
+
+func TestCompareICMP(t *testing.T) {
+	echo := []byte{8, 0, 0x12, 0x34, 0x00, 0x2a, 0x00, 0x05, 'P', 'I', 'N', 'G'}
+	probe := Probe{Src: net.IPv4(10, 0, 0, 1), Dst: net.IPv4(8, 8, 8, 8), Protocol: protoICMP, Transport: echo}
+
+	quoted := []byte{0x45, 0xb8, 0, 32, 0xab, 0xcd, 0, 0, 1, 1, 0, 0, 10, 0, 0, 1, 8, 8, 8, 8}
+	quoted = append(quoted, echo...)
+	quoted[20+5] = 0x99
+
+	changes := Compare(probe, quoted)
+	want := []Change{
+		{Field: "DSCP", Sent: "0", Received: "46"},
+		{Field: "ICMP ID", Sent: "0x002a", Received: "0x0099"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got: %v, want: %v", changes, want)
+	}
+	if got := changes[0].String(); got != "DSCP 0 -> 46" {
+		t.Errorf("got: %q", got)
+	}
+}
+
+func TestCompareInvalid(t *testing.T) {
+	probe := Probe{Protocol: protoTCP}
+	for _, quoted := range [][]byte{nil, {0x45, 0}, make([]byte, 20), {0x4f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		if changes := Compare(probe, quoted); changes != nil {
+			t.Errorf("%x: unexpected changes: %v", quoted, changes)
+		}
+	}
+}
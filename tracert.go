@@ -1,53 +1,335 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
 
+	"github.com/monmohan/traceroute/asn"
 	"github.com/monmohan/traceroute/icmp"
+	"github.com/monmohan/traceroute/netio"
+	"github.com/monmohan/traceroute/netns"
+	"github.com/monmohan/traceroute/pcapng"
+	"github.com/monmohan/traceroute/route"
 	"github.com/monmohan/traceroute/tcp"
+	"github.com/monmohan/traceroute/trace"
 )
 
 func main() {
-	verbose := flag.Bool("verbose", false, "Enable verbose output")
-	port := flag.Int("port", 80, "Port number when using TCP protocol")
-	maxHops := flag.Int("maxHops", 64, "Maximum number of hops")
-	proto := flag.String("proto", "icmp", "Protocol to use: 'tcp' or 'icmp'")
-	iface := flag.String("iface", "any", `Interface to listen on. By default the program attempts to listens on all interfaces however it may not work on all platforms. 
-	Provide the specific interface name if you face issues`)
-
-	flag.Parse()
-	if *maxHops < 1 {
-		fmt.Println("Invalid number of hops, setting to default 64")
-		*maxHops = 64
+	if len(os.Args) > 1 && os.Args[1] == "asn" {
+		runASN(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simnet" {
+		runSimnet(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		runBatch(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "exporter" {
+		runExporter(os.Args[2:])
+		return
 	}
 
-	if *proto == "" || flag.NArg() < 1 {
-		fmt.Println("Usage: tracert -proto [icmp|tcp] -verbose -port <port> -maxHops <maxHops> <Domin/IP address>")
+	newTracer := traceFlags(flag.CommandLine)
+	jsonOut := flag.Bool("json", false, "Print the result as JSON on stdout, progress output goes to stderr")
+
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: tracert -proto [icmp|tcp] -verbose -port <port> -maxHops <maxHops> -asn-db <path> <Domin/IP address>")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	// with -json stdout is for the result only
+	out := io.Writer(os.Stdout)
+	if *jsonOut {
+		out = os.Stderr
+	}
+
 	ipAddress := flag.Arg(0)
 	// Resolve the IP address
 	addr, err := net.ResolveIPAddr("ip4", ipAddress)
 	if err != nil {
-		fmt.Println("Failed to resolve IP address:", err)
+		fmt.Fprintln(out, "Failed to resolve IP address:", err)
 		os.Exit(1)
 	}
-	fmt.Println("Resolved IP address:", addr)
+	fmt.Fprintln(out, "Resolved IP address:", addr)
 
-	switch *proto {
-	case "icmp":
-		icmp.Trace(*verbose, *maxHops, addr)
+	t := newTracer(out)
+	defer t.Close()
+
+	result, err := t.run(addr, t.proto, t.port, t.opts)
+	if err != nil {
+		fmt.Fprintln(out, "Trace failed:", err)
+		os.Exit(1)
+	}
+	result.PrintASPath(out)
+	result.PrintAnomalies(out)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintln(out, "Failed to encode result:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// tracer runs traces as set up by the command line flags, any number of them at once
+type tracer struct {
+	// proto and port are the defaults, batch targets can pick their own
+	proto string
+	port  int
+	// dev is the device the probes are bound to, it decides the routing table and where replies are captured
+	dev    string
+	source net.IP
+	nsPath string
+	opts   trace.Options
 
+	pcapFile *os.File
+	// the raw sockets and captures shared by the traces, by protocol and source address
+	mu    sync.Mutex
+	muxes map[string]*netio.Mux
+}
+
+/*
+traceFlags registers the flags setting up traces on fs. The returned function checks them and builds the tracer,
+exiting if they are invalid. What it has to say goes to out, which is where the traces print their progress too
+unless opts.Out is changed.
+*/
+func traceFlags(fs *flag.FlagSet) func(out io.Writer) *tracer {
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	port := fs.Int("port", 80, "Port number when using TCP protocol")
+	maxHops := fs.Int("maxHops", 64, "Maximum number of hops")
+	proto := fs.String("proto", "icmp", "Protocol to use: 'tcp' or 'icmp'")
+	iface := fs.String("iface", "", `Interface to trace through, its address is the source unless -source is set. In TCP mode replies are captured on it.
+	By default the route to the target decides, and TCP mode listens on all interfaces, which may not work on all platforms`)
+	source := fs.String("source", "", "Source address of the probes, by default the one the route to the target uses")
+	bindDevice := fs.String("bind-device", "", "Bind the probe sockets to this device or VRF (SO_BINDTODEVICE), replies are listened for on it too")
+	fwmark := fs.Int("fwmark", 0, "Firewall mark to set on the probes (SO_MARK), for policy routing")
+	tos := fs.Int("tos", 0, "TOS byte of the probes, DSCP and ECN together. Hops report whether the marking survived")
+	dscp := fs.Int("dscp", 0, "DSCP of the probes, e.g. 46 for EF")
+	ecn := fs.Int("ecn", 0, "ECN codepoint of the probes: 1 ECT(1), 2 ECT(0), 3 CE")
+	netnsSpec := fs.String("netns", "", "Trace from inside this network namespace: a name from 'ip netns', a path such as /proc/<pid>/ns/net, or a PID")
+	loadASNFlags := asnFlags(fs)
+	queries := fs.Int("queries", 1, "Number of probes per TTL, more than one reveals load balanced paths")
+	writePcap := fs.String("write-pcap", "", "Write every probe and matched reply to this pcapng file")
+
+	return func(out io.Writer) *tracer {
+		if *maxHops < 1 {
+			fmt.Fprintln(out, "Invalid number of hops, setting to default 64")
+			*maxHops = 64
+		}
+		if *queries < 1 {
+			fmt.Fprintln(out, "Invalid number of queries, setting to default 1")
+			*queries = 1
+		}
+		// the TTL and the query are a byte each in the ICMP sequence numbers, the TTL is one in the TCP source ports
+		if *maxHops > 255 || *queries > 255 {
+			fmt.Fprintln(out, "Invalid number of hops or queries, the maximum is 255")
+			os.Exit(1)
+		}
+		if *proto != "icmp" && *proto != "tcp" {
+			fmt.Fprintf(out, "Invalid Protocol specified: %s\n", *proto)
+			os.Exit(1)
+		}
+		if *tos < 0 || *tos > 255 || *dscp < 0 || *dscp > 63 || *ecn < 0 || *ecn > 3 {
+			fmt.Fprintln(out, "Invalid marking, -tos is 0-255, -dscp 0-63 and -ecn 0-3")
+			os.Exit(1)
+		}
+		if *tos != 0 && (*dscp != 0 || *ecn != 0) {
+			fmt.Fprintln(out, "Use either -tos or -dscp and -ecn")
+			os.Exit(1)
+		}
+		// any was the default before routes were looked up, it still means no interface in particular
+		if *iface == "any" {
+			*iface = ""
+		}
+		t := &tracer{proto: *proto, port: *port, dev: *iface, muxes: make(map[string]*netio.Mux)}
+		if *source != "" {
+			if t.source = net.ParseIP(*source).To4(); t.source == nil {
+				fmt.Fprintln(out, "Invalid source address:", *source)
+				os.Exit(1)
+			}
+		}
+		if *netnsSpec != "" {
+			var err error
+			if t.nsPath, err = netns.Path(*netnsSpec); err != nil {
+				fmt.Fprintln(out, err)
+				os.Exit(1)
+			}
+		}
+		t.opts = trace.Options{
+			Verbose: *verbose,
+			MaxHops: *maxHops,
+			Queries: *queries,
+			Socket:  netio.SocketOptions{BindDevice: *bindDevice, Mark: *fwmark, TOS: uint8(*tos | *dscp<<2 | *ecn)},
+			ASN:     loadASNFlags(out),
+			Out:     out,
+		}
+		if t.dev == "" {
+			t.dev = *bindDevice
+		}
+
+		if *writePcap != "" {
+			f, err := os.Create(*writePcap)
+			if err != nil {
+				fmt.Fprintln(out, "Failed to create capture file:", err)
+				os.Exit(1)
+			}
+			t.pcapFile = f
+			if t.opts.Capture, err = pcapng.NewWriter(f); err != nil {
+				fmt.Fprintln(out, "Failed to write capture file:", err)
+				os.Exit(1)
+			}
+		}
+		return t
+	}
+}
+
+/*
+run traces addr with proto and port, opts are those of the tracer with per-trace changes. Everything touching
+the network runs inside the namespace when -netns is set.
+*/
+func (t *tracer) run(addr *net.IPAddr, proto string, port int, opts trace.Options) (*trace.Result, error) {
+	var result *trace.Result
+	probe := func() error {
+		// looked up once, every probe of the trace leaves from the same address
+		rt, err := route.Lookup(addr.IP, t.dev, opts.Socket.Mark)
+		if err != nil && t.source == nil {
+			return fmt.Errorf("failed to pick a source address: %v", err)
+		}
+		if t.source != nil {
+			rt.Src = t.source
+		}
+		opts.Src = rt.Src
+		if rt.Iface != "" {
+			fmt.Fprintf(opts.Output(), "Tracing from %s on %s\n", rt.Src, rt.Iface)
+		} else {
+			fmt.Fprintln(opts.Output(), "Tracing from", rt.Src)
+		}
+		mux, err := t.mux(proto, rt.Src)
+		if err != nil {
+			return err
+		}
+
+		switch proto {
+		case "icmp":
+			result, err = icmp.TraceOn(mux, addr, opts)
+
+		case "tcp":
+			result, err = tcp.TraceOn(mux, addr, port, opts)
+		}
+		return err
+	}
+	var err error
+	if t.nsPath != "" {
+		fmt.Fprintln(opts.Output(), "Entering network namespace", t.nsPath)
+		err = netns.Do(t.nsPath, probe)
+	} else {
+		err = probe()
+	}
+	return result, err
+}
+
+// mux returns the connection shared by the traces of proto from src, it is opened by the first of them
+func (t *tracer) mux(proto string, src net.IP) (*netio.Mux, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := proto + " " + src.String()
+	if mux, ok := t.muxes[key]; ok {
+		return mux, nil
+	}
+	var mux *netio.Mux
+	var err error
+	switch proto {
+	case "icmp":
+		mux, err = icmp.NewMux(src, t.opts.Socket)
 	case "tcp":
-		tcp.Trace(*iface, *verbose, *maxHops, addr, *port)
+		if t.opts.Verbose && t.dev != "" {
+			fmt.Fprintln(t.opts.Output(), "Capturing packets on interface", t.dev)
+		}
+		mux, err = tcp.NewMux(t.dev, src, t.opts.Socket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.muxes[key] = mux
+	return mux, nil
+}
 
+// Close closes the shared connections and the capture file, if there is one
+func (t *tracer) Close() error {
+	t.mu.Lock()
+	for key, mux := range t.muxes {
+		mux.Close()
+		delete(t.muxes, key)
+	}
+	t.mu.Unlock()
+	if t.pcapFile == nil {
+		return nil
+	}
+	return t.pcapFile.Close()
+}
+
+// asnFlags registers the ASN lookup flags on fs, the returned function loads the backend they select and tells out why lookups are disabled.
+func asnFlags(fs *flag.FlagSet) func(out io.Writer) asn.Query {
+	lenient := fs.Bool("asn-lenient", false, "Skip malformed rows in the ASN dataset instead of disabling ASN lookups")
+	db := fs.String("asn-db", "", "Path to the ip2asn TSV dataset (plain or gzip) or a compiled snapshot. Defaults to $"+asn.EnvDB+", the embedded dataset, "+asn.DefaultSnapshotPath+" or "+asn.DefaultPath)
+	source := fs.String("asn-source", "local", "ASN lookup backend: 'local' (ip2asn dataset), 'cymru' (Team Cymru DNS, falling back to the local dataset) or 'mmdb' (MaxMind databases)")
+	mmdbASN := fs.String("mmdb-asn", "", "Path to a GeoLite2/GeoIP2 ASN database, used with -asn-source mmdb")
+	mmdbCity := fs.String("mmdb-city", "", "Path to a GeoLite2/GeoIP2 City database, used with -asn-source mmdb")
+	return func(out io.Writer) asn.Query {
+		return loadASN(out, *source, *db, *lenient, *mmdbASN, *mmdbCity)
+	}
+}
+
+// loadASN builds the ASN backend selected by source. A nil Query is returned when lookups are unavailable.
+func loadASN(out io.Writer, source string, db string, lenient bool, mmdbASN string, mmdbCity string) asn.Query {
+	if source == "mmdb" {
+		query, err := asn.OpenMMDB(mmdbASN, mmdbCity)
+		if err != nil {
+			fmt.Fprintln(out, "ASN lookups disabled:", err)
+			return nil
+		}
+		return query
+	}
+
+	local, err := asn.LoadLocal(db, lenient)
+	if rr, ok := local.(*asn.RangeReader); ok && rr.Skipped > 0 {
+		fmt.Fprintf(out, "Skipped %d malformed rows in ASN dataset\n", rr.Skipped)
+	}
+
+	switch source {
+	case "cymru":
+		if err != nil {
+			return asn.NewCymruQuery(nil, nil)
+		}
+		return asn.NewCymruQuery(nil, local)
+	case "local":
+		if err != nil {
+			fmt.Fprintln(out, "ASN lookups disabled:", err)
+			return nil
+		}
+		return local
 	default:
-		fmt.Printf("Invalid Protocol specified: %s\n", *proto)
-		os.Exit(1)
+		fmt.Fprintf(out, "Invalid ASN source specified: %s, ASN lookups disabled\n", source)
+		return nil
 	}
 }